@@ -0,0 +1,172 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"errors"
+	"github.com/anuragkumar19/binding"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var ErrChannelArchived = errors.New("channel is archived and read-only")
+
+// ChannelArchived tells whether a channel has been archived
+func ChannelArchived(channelID uuid.UUID) bool {
+	var count int64
+	server.DB.Model(&Channel{}).Where("id = ? AND archived_at IS NOT NULL", channelID).Count(&count)
+	return count > 0
+}
+
+// writable checks that a channel still takes changes, archived channels being read-only. Direct messages,
+// without a channel, always do.
+func writable(channelID *uuid.UUID) error {
+	if channelID != nil && ChannelArchived(*channelID) {
+		return ErrChannelArchived
+	}
+	return nil
+}
+
+// ArchiveChannel archives a channel, making it read-only and leaving it out of channel lists, or restores it
+func ArchiveChannel(user users.User, channelID uuid.UUID, archive bool) (channel Channel, err error) {
+	err = server.DB.Where("id = ?", channelID).First(&channel).Error
+	if err != nil {
+		return
+	}
+	if archive == (channel.ArchivedAt != nil) {
+		return channel, nil
+	}
+
+	if archive {
+		now := time.Now()
+		channel.ArchivedAt, channel.ArchivedByID = &now, &user.ID
+	} else {
+		channel.ArchivedAt, channel.ArchivedByID = nil, nil
+	}
+	err = server.DB.Model(&channel).Select("archived_at", "archived_by_id").Updates(&channel).Error
+	if err != nil {
+		slog.Error("unable to archive channel", slog.String("channelID", channelID.String()), slog.Any("err", err))
+	}
+	return
+}
+
+// ArchiveChannelPosting archives or restores a channel, with a {"archive": true|false} body
+func ArchiveChannelPosting(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	if !IsModerator(user.ID, id) {
+		roleError(w, r, ErrNotModerator)
+		return
+	}
+
+	type param struct {
+		Archive bool `json:"archive" binding:""`
+	}
+	archiveParam := param{}
+	if err := binding.Bind(r, &archiveParam); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"status": "fail",
+			"err": err.Error() + " - Check JSON body input is not malformed"})
+		return
+	}
+
+	channel, err := ArchiveChannel(user, id, archiveParam.Archive)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, channel)
+}
+
+// PurgeChannel removes a channel for good, with its messages and everything hanging off them, its reads,
+// participants, pins and invites, and drops them from the search index
+func PurgeChannel(channelID uuid.UUID) error {
+	var messageIDs []uuid.UUID
+	err := server.DB.Model(&Message{}).Where("channel_id = ?", channelID).Pluck("id", &messageIDs).Error
+	if err != nil {
+		return err
+	}
+	messages := server.DB.Model(&Message{}).Select("id").Where("channel_id = ?", channelID)
+	invites := server.DB.Model(&ChannelInvite{}).Select("id").Where("channel_id = ?", channelID)
+
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&MessageTag{}, &MessageLike{}, &MessageReaction{}, &MessageRead{},
+			&MessageRevision{}, &SavedMessage{}, &MessageMention{}} {
+			if err := tx.Unscoped().Where("message_id IN (?)", messages).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("thread_id IN (?)", messages).Delete(&ThreadSubscription{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("invite_id IN (?)", invites).Delete(&InviteRedemption{}).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{&Message{}, &Read{}, &ChannelParticipant{}, &ChannelPin{}, &ChannelInvite{},
+			&ChannelSequence{}, &ChannelAck{}} {
+			if err := tx.Unscoped().Where("channel_id = ?", channelID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("id = ?", channelID).Delete(&Channel{}).Error
+	})
+	if err != nil {
+		slog.Error("unable to purge channel", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return err
+	}
+	// huddles live with the messaging server, which drops those of the channel
+	emit(Event{Type: "purge", ChannelID: channelID})
+
+	go func() {
+		server.RemoveEntry(channelID)
+		for _, id := range messageIDs {
+			server.RemoveEntry(id)
+		}
+	}()
+	return nil
+}
+
+// PurgeChannelPosting permanently deletes a channel, for administrators
+func PurgeChannelPosting(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	if !users.IsAdmin(user) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"status": "error", "err": "only administrators can do this"})
+		return
+	}
+
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+
+	var channel Channel
+	err = server.DB.Where("id = ?", id).First(&channel).Error
+	if err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	if err = PurgeChannel(id); err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, render.M{"status": "OK"})
+}
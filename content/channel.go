@@ -12,6 +12,7 @@ import (
 	"log/slog"
 	"math"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -26,11 +27,13 @@ type Channel struct {
 	Open         bool         `json:"open"`
 	Promote      bool         `json:"promote"`
 	Participants []users.User `json:"participants" gorm:"many2many:channel_participants"`
-	Moderators   []users.User `json:"-" gorm:"many2many:channel_moderators"`
 	Messages     []Message    `json:"messages" gorm:"foreignKey:ChannelID"`
 	Read         []Read       `json:"read" gorm:"foreignKey:ChannelID"`
 	UnreadCount  int          `json:"unread" gorm:"-"`
+	MentionCount int          `json:"mentions" gorm:"-"` // unread messages mentioning the user
 	Url          string       `json:"url"`
+	ArchivedAt   *time.Time   `json:"archivedAt,omitempty"` // archived channels are read-only
+	ArchivedByID *uuid.UUID   `json:"archivedById,omitempty" gorm:"type:char(36)"`
 }
 
 type Member struct {
@@ -53,6 +56,58 @@ type ChannelParticipant struct {
 	ChannelID   uuid.UUID `json:"channelId" gorm:"primaryKey"`
 	UserID      uuid.UUID `json:"userId" gorm:"primaryKey"`
 	Approved    bool      `json:"approved"`
+	Role        string    `json:"role" gorm:"type:varchar(16);default:member"` // owner, moderator or member
+}
+
+// ChannelParticipantIDs returns the ids of the approved participants of a channel, the users allowed to
+// see what goes on in it
+func ChannelParticipantIDs(channelID uuid.UUID) (ids []uuid.UUID, err error) {
+	err = server.DB.Model(&ChannelParticipant{}).
+		Where("channel_id = ? AND approved = ?", channelID, true).
+		Pluck("user_id", &ids).Error
+	if err != nil {
+		slog.Error("unable to load channel participants", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return nil, err
+	}
+	return
+}
+
+// CoParticipantIDs returns the ids of the users sharing at least one channel with the given user
+func CoParticipantIDs(userID uuid.UUID) (ids []uuid.UUID, err error) {
+	err = server.DB.Model(&ChannelParticipant{}).Distinct("user_id").
+		Where("approved = ? AND user_id != ? AND channel_id IN (?)", true, userID,
+			server.DB.Table("channel_participants").Select("channel_id").Where("user_id = ? AND approved = ?", userID, true)).
+		Pluck("user_id", &ids).Error
+	if err != nil {
+		slog.Error("unable to load co-participants", slog.String("userID", userID.String()), slog.Any("err", err))
+		return nil, err
+	}
+	return
+}
+
+// CanPost checks that a user may post in a channel; closed channels need an approved participant, open
+// channels any participant, and archived channels take no posts at all
+func CanPost(userID uuid.UUID, channelID uuid.UUID) error {
+	var channel Channel
+	err := server.DB.Select("id", "open", "archived_at").Where("id = ?", channelID).First(&channel).Error
+	if err != nil {
+		return err
+	}
+	if channel.ArchivedAt != nil {
+		return ErrChannelArchived
+	}
+
+	var participant ChannelParticipant
+	err = server.DB.Where("channel_id = ? AND user_id = ?", channelID, userID).First(&participant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotParticipant
+	} else if err != nil {
+		return err
+	}
+	if !channel.Open && !participant.Approved {
+		return ErrNotParticipant
+	}
+	return nil
 }
 
 func GetChannel(w http.ResponseWriter, r *http.Request) {
@@ -111,6 +166,14 @@ func SubscribeToChannel(w http.ResponseWriter, r *http.Request) {
 		subscribeParam.UserID = user.ID
 	}
 
+	// adding or removing someone else is up to the moderators, and owners can't walk away from their channel
+	if subscribeParam.UserID != user.ID || !subscribeParam.Subscribe {
+		if err := CanManageMember(user.ID, id, subscribeParam.UserID); err != nil {
+			roleError(w, r, err)
+			return
+		}
+	}
+
 	var channel Channel
 	err = server.DB.
 		Preload("Read").
@@ -121,6 +184,26 @@ func SubscribeToChannel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// archived channels take no new members, but members may still leave
+	if subscribeParam.Subscribe {
+		if err := writable(&channel.ID); err != nil {
+			roleError(w, r, err)
+			return
+		}
+	}
+
+	// asking to join a closed channel leaves a request for its moderators to answer
+	if subscribeParam.Subscribe && !channel.Open && subscribeParam.UserID == user.ID && ChannelRole(user.ID, id) == "" {
+		if err := RequestToJoin(user, channel); err != nil {
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, render.M{"status": "fail", "err": err.Error()})
+			return
+		}
+		render.Status(r, http.StatusAccepted)
+		render.JSON(w, r, channel)
+		return
+	}
+
 	usermod := &users.User{}
 	usermod.ID = subscribeParam.UserID
 
@@ -136,9 +219,10 @@ func SubscribeToChannel(w http.ResponseWriter, r *http.Request) {
 			Assign(subscriber).
 			FirstOrCreate(&ChannelParticipant{}).Error
 
+		// subscribing again keeps the role in the channel
 		err = server.DB.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "channel_id"}, {Name: "user_id"}},
-			UpdateAll: true,
+			DoUpdates: clause.AssignmentColumns([]string{"approved", "created_by_id", "updated_at"}),
 		}).Create(&subscriber).Error
 
 		UserSubscribed(user, channel)
@@ -157,19 +241,16 @@ func SubscribeToChannel(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, channel)
 }
 
+// UserSubscribed announces a new member of a channel with a system message, sequenced like any other
+// message of the channel so that clients catching up replay it
 func UserSubscribed(user users.User, channel Channel) {
 
-	var msg Message
-	msg.UserID = user.ID
-	msg.MessageType = "system"
-	msg.SystemFlags = "subscribed"
-	msg.ChannelID = &channel.ID
-
-	err := server.DB.Create(&msg).Error
-
+	msg, err := SaveSystemMessage(Message{UserID: user.ID, SystemFlags: "subscribed", ChannelID: &channel.ID})
 	if err != nil {
 		slog.Error("unable to create new system message", slog.Any("err", err))
+		return
 	}
+	emit(Event{Type: "msg", UserID: user.ID, Message: &msg})
 }
 
 func GetSubscriptions(w http.ResponseWriter, r *http.Request) {
@@ -215,7 +296,7 @@ func GetSuggestions(w http.ResponseWriter, r *http.Request) {
 	}).Where("id NOT IN (?)", server.DB.Table("channel_participants").
 		Select("channel_id").
 		Where("user_id = ?", user.ID),
-	).Model(&suggestions).Order("created_at desc").Find(&suggestions).Error
+	).Where("archived_at IS NULL").Model(&suggestions).Order("created_at desc").Find(&suggestions).Error
 
 	if err != nil {
 		render.Status(r, http.StatusNotFound)
@@ -270,15 +351,15 @@ func SaveChannel(w http.ResponseWriter, r *http.Request) {
 	if id == uuid.Nil {
 		channel = channelMod
 
-		channel.Moderators = []users.User{user}
-
 		err = server.DB.Create(&channel).Error
 
+		// whoever creates a channel owns it
 		var subscriber ChannelParticipant
 		subscriber.UserID = user.ID
 		subscriber.ChannelID = channel.ID
 		subscriber.Approved = true
 		subscriber.CreatedByID = user.ID
+		subscriber.Role = RoleOwner
 
 		err = server.DB.Where(subscriber).Assign(subscriber).FirstOrCreate(&ChannelParticipant{}).Error
 
@@ -297,6 +378,10 @@ func SaveChannel(w http.ResponseWriter, r *http.Request) {
 			render.JSON(w, r, render.M{"status": "fail", "err": err.Error()})
 			return
 		}
+		if !IsModerator(user.ID, id) {
+			roleError(w, r, ErrNotModerator)
+			return
+		}
 		err = server.DB.Model(&channel).Updates(channelMod).Error
 		status = http.StatusOK
 	}
@@ -337,17 +422,23 @@ func GetChannels(w http.ResponseWriter, r *http.Request) {
 	// https://stackoverflow.com/questions/52270257/how-do-i-stop-gorm-from-sorting-my-preload-by-id
 	// https://gorm.io/docs/preload.html
 
+	// archived channels are left out unless asked for
+	listed := server.DB
+	if r.URL.Query().Get("archived") != "true" {
+		listed = server.DB.Where("archived_at IS NULL")
+	}
+
 	var totalCount int64
 	var err error
 	if query != "" {
 		// TODO for all=false
-		err = server.DB.
+		err = listed.
 			Model(&channels).Preload("Read").Preload("Participants").Preload("Messages", func(db *gorm.DB) *gorm.DB {
 			return db.Order("created_at desc limit 3")
-		}).Where("title LIKE ? or description LIKE ?", "%"+query+"%", "%"+query+"%").Count(&totalCount).Limit(pageSize).Offset(page * pageSize).Order("created_at desc").Find(&channels).Error
+		}).Where("(title LIKE ? or description LIKE ?)", "%"+query+"%", "%"+query+"%").Count(&totalCount).Limit(pageSize).Offset(page * pageSize).Order("created_at desc").Find(&channels).Error
 	} else {
 		if all {
-			err = server.DB.
+			err = listed.
 				Model(&channels).Preload("Read").Preload("Participants").Preload("Messages", func(db *gorm.DB) *gorm.DB {
 				return db.Order("created_at desc limit 3")
 			}).Model(&channels).Count(&totalCount).Limit(pageSize).Offset(page * pageSize).
@@ -362,7 +453,7 @@ func GetChannels(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// See https://stackoverflow.com/questions/63475885/how-to-query-a-many2many-relationship-with-a-where-clause-on-the-association-wit
-			err = server.DB.Model(&channels).Preload("Read").Preload("Participants").Preload("Messages", func(db *gorm.DB) *gorm.DB {
+			err = listed.Model(&channels).Preload("Read").Preload("Participants").Preload("Messages", func(db *gorm.DB) *gorm.DB {
 				return db.Order("created_at desc limit 3")
 			}).Where("id IN (?)", channelSelect).Model(&channels).Count(&totalCount).Limit(pageSize).Offset(page * pageSize).
 				Order("created_at desc").Find(&channels).Error
@@ -371,7 +462,6 @@ func GetChannels(w http.ResponseWriter, r *http.Request) {
 	if messages {
 		for i, _ := range channels {
 			channels[i].Messages, err = LoadChannelMessages(channels[i].ID, nil, 10)
-			channels[i].UnreadCount = len(channels[i].Messages)
 			if err != nil {
 				slog.Error("unable to load channel messages", slog.String("channelID", channels[i].ID.String()), slog.Any("err", err))
 			}
@@ -383,29 +473,18 @@ func GetChannels(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
 		return
 	} else {
-		for i, _ := range channels {
-			unreadCount := len(channels[i].Messages)
-			readAt := time.UnixMilli(0)
-			for _, r := range channels[i].Read {
-				if r.UserID == user.ID {
-					readAt = r.ReadAt
-					unreadCount = -1
-				}
-			}
-
-			// loop through messages to get unreadCount
-			if unreadCount == -1 {
-				unreadCount = 0
-				for _, m := range channels[i].Messages {
-					if m.CreatedAt.After(readAt) {
-						// found one message after
-						unreadCount++
-					} else {
-						// found one message before
-					}
-				}
-			}
-			channels[i].UnreadCount = unreadCount
+		ids := make([]uuid.UUID, len(channels))
+		for i := range channels {
+			ids[i] = channels[i].ID
+		}
+		counts, err := UnreadCounts(user.ID, ids)
+		if err != nil {
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+			return
+		}
+		for i := range channels {
+			channels[i].UnreadCount, channels[i].MentionCount = counts[channels[i].ID].Unread, counts[channels[i].ID].Mentions
 		}
 
 		pageCount := int(math.Ceil(float64(totalCount) / float64(pageSize)))
@@ -416,7 +495,7 @@ func GetChannels(w http.ResponseWriter, r *http.Request) {
 func LoadChannels(ids []string) (channels []Channel) {
 
 	count := 10
-	err := server.DB.Preload("Messages").Preload("Participants").Preload("Moderators").Order("created_at desc").
+	err := server.DB.Preload("Messages").Preload("Participants").Order("created_at desc").
 		Where("id IN (?)", ids).Limit(count).Find(&channels).Error
 
 	if err != nil {
@@ -428,15 +507,21 @@ func LoadChannels(ids []string) (channels []Channel) {
 
 func DeleteChannel(w http.ResponseWriter, r *http.Request) {
 
+	user := r.Context().Value("loggedInUser").(users.User)
+
 	id, err := uuid.FromString(chi.URLParam(r, "id"))
 	if err != nil {
 		abort(w, r, err)
 		return
 	}
 
-	var channel Channel
-	err = server.DB.
-		Preload("Read").Where("id = ?", id.String()).Delete(&channel).Error
+	if ChannelRole(user.ID, id) != RoleOwner {
+		roleError(w, r, ErrNotOwner)
+		return
+	}
+
+	// owners deleting a channel archive it; only administrators remove channels for good
+	_, err = ArchiveChannel(user, id, true)
 	if err != nil {
 		render.Status(r, http.StatusBadRequest)
 		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
@@ -469,28 +554,45 @@ func ReadChannel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var readMod Read
-
-	readMod.ReadAt = time.Now()
-	readMod.ChannelID = id
-	readMod.UserID = user.ID
-
-	// We do an upsert so that a read timestamp is inserted or updated if already exists
-	// https://stackoverflow.com/questions/48915482/upsert-if-on-conflict-occurs-on-multiple-columns-in-postgres-db
-	// https://gorm.io/docs/create.html
-	server.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "channel_id"}, {Name: "user_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"read_at"}),
-	}).Create(&readMod)
+	if ChannelRole(user.ID, id) == "" {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"status": "error", "err": ErrNotParticipant.Error()})
+		return
+	}
 
+	err = AdvanceRead(id, user.ID, time.Now())
 	if err != nil {
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
 		return
 	}
+	emit(Event{Type: "unread", UserID: user.ID})
 	render.JSON(w, r, render.M{"status": "OK"})
 }
 
+// AdvanceRead moves the read watermark of a user in a channel forward to readAt. The watermark never moves
+// backwards, so reads arriving out of order from several devices don't resurrect unread messages.
+func AdvanceRead(channelID, userID uuid.UUID, readAt time.Time) error {
+
+	readMod := Read{ChannelID: channelID, UserID: userID, ReadAt: readAt}
+
+	// We insert the watermark if it doesn't exist yet and only update it if it moves forward
+	// https://gorm.io/docs/create.html
+	err := server.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&readMod).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Read{}).Where("channel_id = ? AND user_id = ? AND read_at < ?", channelID, userID, readAt).
+			Update("read_at", readAt).Error
+	})
+
+	if err != nil {
+		slog.Error("unable to advance read watermark", slog.String("channelID", channelID.String()), slog.Any("err", err))
+	}
+	return err
+}
+
 // find unread thread count?
 // https://dba.stackexchange.com/questions/69074/mysql-querying-for-latest-messages-in-flat-reply-system
 // Do we also mark all replies to the provided posting id?
@@ -505,31 +607,23 @@ func ReadPosting(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var readMod MessageRead
-
 	// allow sending in read state to set a specific readAt timestamp
 	/*if err := render.Bind(r, &readMod); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"status": "fail",
 			"err": err.Error() + " - Check JSON body input is not malformed"})
 		return
 	}*/
-	readMod.ReadAt = time.Now()
-	readMod.MessageID = id
-	readMod.UserID = user.ID
-
-	server.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "message_id"}, {Name: "user_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"read_at"}),
-	}).Create(&readMod)
+	readMod, err := ReadPost(id, user.ID)
 
 	if err != nil {
-		render.Status(r, http.StatusInternalServerError)
-		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		reactionError(w, r, err)
 		return
 	}
+	emit(Event{Type: "read", UserID: user.ID, Read: &readMod})
 	render.JSON(w, r, render.M{"status": "OK"})
 }
 
+// LikePosting likes a message, which is reacting to it with the default emoji
 func LikePosting(w http.ResponseWriter, r *http.Request) {
 
 	user := r.Context().Value("loggedInUser").(users.User)
@@ -541,67 +635,59 @@ func LikePosting(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var likeMod MessageLike
-
-	// allow sending in read state to set a specific likeAt timestamp
-	likeMod.LikeAt = time.Now()
-	likeMod.MessageID = id
-	likeMod.UserID = user.ID
-
-	server.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "message_id"}, {Name: "user_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"like_at"}),
-	}).Create(&likeMod)
-
+	reaction, changed, err := React(id, user.ID, DefaultReaction, false)
 	if err != nil {
-		render.Status(r, http.StatusInternalServerError)
-		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		reactionError(w, r, err)
 		return
 	}
+	if changed {
+		emit(Event{Type: "react", UserID: user.ID, Reaction: &reaction})
+	}
 	render.JSON(w, r, render.M{"status": "OK"})
 }
 
-func LikePost(messageID uuid.UUID, userID uuid.UUID) {
-
-	var likeMod MessageLike
-
-	// allow sending in read state to set a specific likeAt timestamp
-	likeMod.LikeAt = time.Now()
-	likeMod.MessageID = messageID
-	likeMod.UserID = userID
-
-	err := server.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "message_id"}, {Name: "user_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"like_at"}),
-	}).Create(&likeMod)
+// ReadPost persists that a user read a message, and moves the read watermark of its channel along
+func ReadPost(messageID uuid.UUID, userID uuid.UUID) (readMod MessageRead, err error) {
 
+	// only those who can see a message read it
+	audience, err := MessageAudience(messageID)
 	if err != nil {
-		slog.Error("unable to store reaction", slog.String("error", err.Error.Error()))
-		return
+		return readMod, err
+	}
+	if !slices.Contains(audience, userID) {
+		return readMod, ErrNotParticipant
 	}
-}
-
-func ReadPost(messageID uuid.UUID, userID uuid.UUID) {
-
-	var readMod MessageRead
 
-	// allow sending in read state to set a specific readAt timestamp
-	/*if err := render.Bind(r, &readMod); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"status": "fail",
-			"err": err.Error() + " - Check JSON body input is not malformed"})
-		return
-	}*/
 	readMod.ReadAt = time.Now()
 	readMod.MessageID = messageID
 	readMod.UserID = userID
 
-	err := server.DB.Clauses(clause.OnConflict{
+	var msg Message
+	err = server.DB.Select("id", "channel_id", "created_at").Where("id = ?", messageID).First(&msg).Error
+	if err != nil {
+		slog.Error("unable to persist read message", slog.String("error", err.Error()))
+		return
+	}
+	if msg.ChannelID != nil {
+		readMod.Seq, err = NextSequence(*msg.ChannelID)
+		if err != nil {
+			return
+		}
+	}
+
+	err = server.DB.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "message_id"}, {Name: "user_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"read_at"}),
-	}).Create(&readMod)
+		DoUpdates: clause.AssignmentColumns([]string{"read_at", "seq"}),
+	}).Create(&readMod).Error
 
 	if err != nil {
-		slog.Error("unable to persist read message", slog.String("error", err.Error.Error()))
+		slog.Error("unable to persist read message", slog.String("error", err.Error()))
 		return
 	}
+
+	// reading a message also reads everything posted in the channel before it
+	if msg.ChannelID != nil {
+		err = AdvanceRead(*msg.ChannelID, userID, msg.CreatedAt)
+	}
+	return
 }
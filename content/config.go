@@ -22,6 +22,19 @@ func InitSchema() {
 	if err != nil {
 		slog.Error("unable to setup message / tag / like / read schema", slog.Any("err", err))
 	}
+	err = server.DB.AutoMigrate(&MessageRevision{}, &ThreadSubscription{}, &MessageReaction{}, &ChannelPin{}, &SavedMessage{},
+		&MessageMention{})
+	if err != nil {
+		slog.Error("unable to setup message revision / thread / reaction / pin / saved / mention schema", slog.Any("err", err))
+	}
+	err = server.DB.AutoMigrate(&ChannelInvite{}, &InviteRedemption{})
+	if err != nil {
+		slog.Error("unable to setup invite schema", slog.Any("err", err))
+	}
+	err = server.DB.AutoMigrate(&ChannelSequence{}, &ChannelAck{})
+	if err != nil {
+		slog.Error("unable to setup sequence / ack schema", slog.Any("err", err))
+	}
 
 	slog.Info("setting up participants join table")
 	err = server.DB.SetupJoinTable(&Channel{}, "Participants", &ChannelParticipant{})
@@ -29,5 +42,7 @@ func InitSchema() {
 		slog.Error("unable to setup join table for channel participants", slog.Any("err", err))
 	}
 	server.DB.AutoMigrate(&ChannelParticipant{})
+	migrateModerators()
+	migrateLikes()
 
 }
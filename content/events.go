@@ -0,0 +1,39 @@
+package content
+
+import (
+	"github.com/gofrs/uuid"
+	"sync"
+)
+
+// Event is something done through the REST API that connected clients should hear about, the
+// same way they hear about what is done over the web socket
+type Event struct {
+	Type      string    // the protocol frame type, e.g. read, react or delete, or purge for a removed channel
+	UserID    uuid.UUID // who did it
+	ChannelID uuid.UUID // the channel, for events about a channel as a whole
+	Reaction  *MessageReaction
+	Read      *MessageRead
+	Message   *Message
+	Pin       *ChannelPin
+	Member    *ChannelParticipant
+}
+
+var (
+	listenersMu sync.RWMutex
+	listeners   []func(Event)
+)
+
+// OnEvent registers a function called for every event
+func OnEvent(fn func(Event)) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listeners = append(listeners, fn)
+}
+
+func emit(event Event) {
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	for _, fn := range listeners {
+		fn(event)
+	}
+}
@@ -11,7 +11,8 @@ import (
 func Reindex(w http.ResponseWriter, r *http.Request) {
 
 	var messages []Message
-	err := server.DB.Preload("Channel").Preload("User").Preload("Tags").Preload("Likes").Find(&messages).Error
+	err := server.DB.Preload("Channel").Preload("User").Preload("Tags").Preload("Likes").Preload("MessageReactions", liveReactions).
+		Where("deleted_at IS NULL").Find(&messages).Error
 	if err != nil {
 		slog.Error("unable to query messages", slog.Any("err", err))
 	}
@@ -22,7 +23,7 @@ func Reindex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var channels []Channel
-	err = server.DB.Preload("Moderators").Preload("Participants").Find(&channels).Error
+	err = server.DB.Preload("Participants").Find(&channels).Error
 	if err != nil {
 		slog.Error("unable to query channels", slog.Any("err", err))
 	}
@@ -0,0 +1,293 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/anuragkumar19/binding"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrInviteNotFound = errors.New("no such invite")
+	ErrInviteExpired  = errors.New("invite has expired, been revoked or used up")
+)
+
+// ChannelInvite is a link moderators share to let existing users join a channel, closed or not. Invites
+// can expire, be limited to a number of uses, and make whoever joins through them a moderator.
+type ChannelInvite struct {
+	server.Base
+	ChannelID   uuid.UUID          `json:"channelId" gorm:"type:char(36);index"`
+	Code        string             `json:"code" gorm:"type:varchar(32);uniqueIndex"`
+	CreatedByID uuid.UUID          `json:"createdById" gorm:"type:char(36)"`
+	ExpiresAt   *time.Time         `json:"expiresAt,omitempty"`
+	MaxUses     int                `json:"maxUses"` // 0 for no limit
+	Uses        int                `json:"uses"`
+	Role        string             `json:"role" gorm:"type:varchar(16);default:member"`
+	RevokedAt   *time.Time         `json:"revokedAt,omitempty"`
+	Redemptions []InviteRedemption `json:"redemptions,omitempty" gorm:"foreignKey:InviteID"`
+}
+
+// InviteRedemption records a user joining a channel through an invite
+type InviteRedemption struct {
+	server.Base
+	InviteID   uuid.UUID `json:"inviteId" gorm:"type:char(36);uniqueIndex:redemption_idx_invite_id_user_id"`
+	UserID     uuid.UUID `json:"userId" gorm:"type:char(36);uniqueIndex:redemption_idx_invite_id_user_id"`
+	RedeemedAt time.Time `json:"redeemedAt"`
+}
+
+// usable tells whether an invite can still be redeemed
+func (invite ChannelInvite) usable(now time.Time) bool {
+	return invite.RevokedAt == nil && (invite.ExpiresAt == nil || now.Before(*invite.ExpiresAt)) &&
+		(invite.MaxUses == 0 || invite.Uses < invite.MaxUses)
+}
+
+// newInviteCode returns a random code that is hard to guess, to put in invite links
+func newInviteCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// RedeemInvite makes a user an approved participant of the channel of an invite, with the role of the
+// invite. Users that already take part in the channel keep their role and don't use up the invite; a
+// pending request to join is approved.
+func RedeemInvite(user users.User, code string) (channel Channel, err error) {
+	var invite ChannelInvite
+	err = server.DB.Where("code = ?", code).First(&invite).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return channel, ErrInviteNotFound
+	} else if err != nil {
+		return
+	}
+	err = server.DB.Where("id = ?", invite.ChannelID).First(&channel).Error
+	if err != nil {
+		return
+	}
+	if ChannelRole(user.ID, channel.ID) != "" {
+		return channel, nil
+	}
+	if err = writable(&channel.ID); err != nil {
+		return
+	}
+
+	now := time.Now()
+	if !invite.usable(now) {
+		return channel, ErrInviteExpired
+	}
+
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		// count the use unless someone else took the last one first
+		use := tx.Model(&ChannelInvite{}).
+			Where("id = ? AND revoked_at IS NULL AND (max_uses = 0 OR uses < max_uses)", invite.ID).
+			Update("uses", gorm.Expr("uses + 1"))
+		if use.Error != nil {
+			return use.Error
+		}
+		if use.RowsAffected == 0 {
+			return ErrInviteExpired
+		}
+
+		// users that left and come back through the same invite use it again
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "invite_id"}, {Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"redeemed_at", "updated_at"}),
+		}).Create(&InviteRedemption{InviteID: invite.ID, UserID: user.ID, RedeemedAt: now}).Error
+		if err != nil {
+			return err
+		}
+
+		participant := ChannelParticipant{ChannelID: channel.ID, UserID: user.ID, CreatedByID: user.ID, Approved: true, Role: invite.Role}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "channel_id"}, {Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"approved", "role", "updated_at"}),
+		}).Create(&participant).Error
+	})
+	if err != nil {
+		if !errors.Is(err, ErrInviteExpired) {
+			slog.Error("unable to redeem invite", slog.String("inviteID", invite.ID.String()), slog.Any("err", err))
+		}
+		return
+	}
+
+	UserSubscribed(user, channel)
+	return channel, nil
+}
+
+// inviteError answers a failed invite operation
+func inviteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrInviteNotFound), errors.Is(err, gorm.ErrRecordNotFound):
+		render.Status(r, http.StatusNotFound)
+	case errors.Is(err, ErrInviteExpired):
+		render.Status(r, http.StatusGone)
+	default:
+		roleError(w, r, err)
+		return
+	}
+	render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+}
+
+// CreateInvite creates an invite link for a channel, with a {"expiresAt": "<RFC 3339 time>", "maxUses": n,
+// "role": "member|moderator"} body where every field is optional. Only owners hand out moderator invites.
+func CreateInvite(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+
+	type param struct {
+		ExpiresAt *time.Time `json:"expiresAt" binding:""`
+		MaxUses   int        `json:"maxUses" binding:""`
+		Role      string     `json:"role" binding:""`
+	}
+	inviteParam := param{}
+	if r.ContentLength != 0 {
+		if err := binding.Bind(r, &inviteParam); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, render.M{"status": "fail",
+				"err": err.Error() + " - Check JSON body input is not malformed"})
+			return
+		}
+	}
+	if inviteParam.Role == "" {
+		inviteParam.Role = RoleMember
+	}
+
+	role := ChannelRole(user.ID, channelID)
+	if role != RoleOwner && role != RoleModerator {
+		roleError(w, r, ErrNotModerator)
+		return
+	}
+	if err = writable(&channelID); err != nil {
+		roleError(w, r, err)
+		return
+	}
+	switch {
+	case inviteParam.Role != RoleMember && inviteParam.Role != RoleModerator:
+		err = errors.New("invites make members or moderators")
+	case inviteParam.MaxUses < 0:
+		err = errors.New("maxUses can't be negative")
+	case inviteParam.ExpiresAt != nil && !inviteParam.ExpiresAt.After(time.Now()):
+		err = errors.New("expiresAt must be in the future")
+	}
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	if inviteParam.Role == RoleModerator && role != RoleOwner {
+		roleError(w, r, ErrNotOwner)
+		return
+	}
+
+	invite := ChannelInvite{ChannelID: channelID, CreatedByID: user.ID, ExpiresAt: inviteParam.ExpiresAt,
+		MaxUses: inviteParam.MaxUses, Role: inviteParam.Role}
+	invite.Code, err = newInviteCode()
+	if err == nil {
+		err = server.DB.Create(&invite).Error
+	}
+	if err != nil {
+		slog.Error("unable to create invite", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, invite)
+}
+
+// GetInvites lists the invites of a channel with their redemptions, most recent first
+func GetInvites(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	if !IsModerator(user.ID, channelID) {
+		roleError(w, r, ErrNotModerator)
+		return
+	}
+
+	invites := []ChannelInvite{}
+	err = server.DB.Preload("Redemptions", func(db *gorm.DB) *gorm.DB {
+		return db.Order("redeemed_at")
+	}).Where("channel_id = ?", channelID).Order("created_at desc").Find(&invites).Error
+	if err != nil {
+		slog.Error("unable to load invites", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, invites)
+}
+
+// RevokeInvite stops an invite from being redeemed; the invite and its redemptions are kept
+func RevokeInvite(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	inviteID, err := uuid.FromString(chi.URLParam(r, "inviteId"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	if !IsModerator(user.ID, channelID) {
+		roleError(w, r, ErrNotModerator)
+		return
+	}
+
+	var invite ChannelInvite
+	err = server.DB.Where("id = ? AND channel_id = ?", inviteID, channelID).First(&invite).Error
+	if err != nil {
+		inviteError(w, r, err)
+		return
+	}
+	if invite.RevokedAt == nil {
+		now := time.Now()
+		invite.RevokedAt = &now
+		err = server.DB.Model(&invite).Update("revoked_at", now).Error
+		if err != nil {
+			slog.Error("unable to revoke invite", slog.String("inviteID", inviteID.String()), slog.Any("err", err))
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+			return
+		}
+	}
+	render.JSON(w, r, invite)
+}
+
+// RedeemInvitePosting joins the channel of the invite code in the url
+func RedeemInvitePosting(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channel, err := RedeemInvite(user, chi.URLParam(r, "code"))
+	if err != nil {
+		inviteError(w, r, err)
+		return
+	}
+	render.JSON(w, r, channel)
+}
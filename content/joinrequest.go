@@ -0,0 +1,210 @@
+package content
+
+import (
+	"areo/go-chat-backend/email"
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"errors"
+	"github.com/anuragkumar19/binding"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var ErrNoJoinRequest = errors.New("no pending request to join this channel")
+
+// JoinRequest is a pending participant of a closed channel, along with who is asking
+type JoinRequest struct {
+	UserID      uuid.UUID  `json:"userId"`
+	User        users.User `json:"user"`
+	ChannelID   uuid.UUID  `json:"channelId"`
+	RequestedAt time.Time  `json:"requestedAt"`
+}
+
+// ModeratorIDs returns the ids of the owners and moderators of a channel
+func ModeratorIDs(channelID uuid.UUID) (ids []uuid.UUID, err error) {
+	err = server.DB.Model(&ChannelParticipant{}).
+		Where("channel_id = ? AND approved = ? AND role IN ?", channelID, true, []string{RoleOwner, RoleModerator}).
+		Pluck("user_id", &ids).Error
+	if err != nil {
+		slog.Error("unable to load channel moderators", slog.String("channelID", channelID.String()), slog.Any("err", err))
+	}
+	return
+}
+
+// SendJoinRequestEmail mails a moderator about a request to join a channel; tests replace it to not send mail
+var SendJoinRequestEmail = email.SendJoinRequestEmail
+
+// RequestToJoin leaves a pending participant for a user asking to join a closed channel, and tells the
+// moderators of the channel about it; over the socket, and by email. Asking again changes nothing.
+func RequestToJoin(user users.User, channel Channel) error {
+	request := ChannelParticipant{ChannelID: channel.ID, UserID: user.ID, CreatedByID: user.ID, Role: RoleMember}
+	result := server.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&request)
+	if result.Error != nil {
+		slog.Error("unable to request to join channel", slog.String("channelID", channel.ID.String()), slog.Any("err", result.Error))
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	emit(Event{Type: "join_request", UserID: user.ID, Member: &request})
+
+	ids, err := ModeratorIDs(channel.ID)
+	if err != nil || len(ids) == 0 {
+		return nil
+	}
+	var moderators []users.User
+	if err := server.DB.Where("id IN ?", ids).Find(&moderators).Error; err != nil {
+		slog.Error("unable to load channel moderators", slog.String("channelID", channel.ID.String()), slog.Any("err", err))
+		return nil
+	}
+	for _, moderator := range moderators {
+		go SendJoinRequestEmail(moderator, user, channel.ID.String(), channel.Title)
+	}
+	return nil
+}
+
+// AnswerJoinRequest approves or rejects a pending request to join a channel. Approved applicants get a
+// system message from the moderator, rejected ones are forgotten.
+func AnswerJoinRequest(moderator users.User, channelID uuid.UUID, userID uuid.UUID, approve bool) (request ChannelParticipant, err error) {
+	if !IsModerator(moderator.ID, channelID) {
+		return request, ErrNotModerator
+	}
+
+	var channel Channel
+	err = server.DB.Where("id = ?", channelID).First(&channel).Error
+	if err != nil {
+		return
+	}
+	if approve {
+		if err = writable(&channelID); err != nil {
+			return
+		}
+	}
+	err = server.DB.Where("channel_id = ? AND user_id = ? AND approved = ?", channelID, userID, false).First(&request).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return request, ErrNoJoinRequest
+	} else if err != nil {
+		return
+	}
+
+	if !approve {
+		err = server.DB.Unscoped().Where("channel_id = ? AND user_id = ? AND approved = ?", channelID, userID, false).
+			Delete(&ChannelParticipant{}).Error
+		if err != nil {
+			slog.Error("unable to reject join request", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		}
+		return
+	}
+
+	request.Approved = true
+	err = server.DB.Model(&ChannelParticipant{}).Where("channel_id = ? AND user_id = ?", channelID, userID).
+		Update("approved", true).Error
+	if err != nil {
+		slog.Error("unable to approve join request", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return
+	}
+
+	var applicant users.User
+	applicant.ID = userID
+	UserSubscribed(applicant, channel)
+
+	msg, err := SaveSystemMessage(Message{UserID: moderator.ID, RecipientID: &userID, SystemFlags: "join_approved",
+		Title: channel.Title, Message: channel.ID.String()})
+	if err != nil {
+		slog.Error("unable to tell applicant about approval", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return request, nil
+	}
+	emit(Event{Type: "msg", UserID: moderator.ID, Message: &msg})
+	return request, nil
+}
+
+// GetJoinRequests lists the pending requests to join a channel, oldest first, for its moderators
+func GetJoinRequests(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	if !IsModerator(user.ID, channelID) {
+		roleError(w, r, ErrNotModerator)
+		return
+	}
+
+	var pending []ChannelParticipant
+	err = server.DB.Where("channel_id = ? AND approved = ?", channelID, false).Order("created_at").Find(&pending).Error
+	var applicants []users.User
+	if err == nil && len(pending) > 0 {
+		ids := make([]uuid.UUID, len(pending))
+		for i, v := range pending {
+			ids[i] = v.UserID
+		}
+		err = server.DB.Where("id IN ?", ids).Find(&applicants).Error
+	}
+	if err != nil {
+		slog.Error("unable to load join requests", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	requests := make([]JoinRequest, 0, len(pending))
+	for _, v := range pending {
+		request := JoinRequest{UserID: v.UserID, ChannelID: v.ChannelID, RequestedAt: v.CreatedAt}
+		for _, applicant := range applicants {
+			if applicant.ID == v.UserID {
+				request.User = applicant
+			}
+		}
+		requests = append(requests, request)
+	}
+	render.JSON(w, r, requests)
+}
+
+// AnswerJoinRequestPosting approves or rejects a request to join a channel, with a {"approve": true|false} body
+func AnswerJoinRequestPosting(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	userID, err := uuid.FromString(chi.URLParam(r, "userId"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+
+	type param struct {
+		Approve bool `json:"approve" binding:""`
+	}
+	answerParam := param{}
+	if err := binding.Bind(r, &answerParam); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"status": "fail",
+			"err": err.Error() + " - Check JSON body input is not malformed"})
+		return
+	}
+
+	request, err := AnswerJoinRequest(user, channelID, userID, answerParam.Approve)
+	if errors.Is(err, ErrNoJoinRequest) || errors.Is(err, gorm.ErrRecordNotFound) {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	} else if err != nil {
+		roleError(w, r, err)
+		return
+	}
+	render.JSON(w, r, request)
+}
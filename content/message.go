@@ -7,6 +7,7 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
 	"github.com/gofrs/uuid"
@@ -19,6 +20,12 @@ import (
 	"time"
 )
 
+var (
+	ErrNotParticipant = errors.New("not a participant of this channel")
+	ErrNotAuthor      = errors.New("only the author or a moderator of the channel can change this message")
+	ErrNoTarget       = errors.New("messages need a channel, a recipient or a message to reply to")
+)
+
 type MessageTag struct {
 	ID        uint      `json:"-" gorm:"primary_key"`
 	Tag       string    `json:"tag" gorm:"type:varchar(255);"`
@@ -70,8 +77,26 @@ type Message struct {
 	Read        []MessageRead `json:"read" gorm:"foreignKey:MessageID"`
 	Tags        []MessageTag  `json:"tags" gorm:"foreignKey:MessageID"`
 
-	Likes       []MessageLike `json:"likes" gorm:"foreignKey:MessageID"`
+	Likes       []MessageLike `json:"likes" gorm:"foreignKey:MessageID"` // legacy, likes are reactions now
 	ExternalURL string        `json:"externalUrl" gorm:"type:char(255)"`
+	Seq         uint64        `json:"seq,omitempty" gorm:"index"` // position in the channel stream
+	EditedAt    *time.Time    `json:"editedAt,omitempty"`         // set once the message has been edited
+
+	// set on tombstones, messages deleted by their author or a moderator
+	DeletedByID  *uuid.UUID `json:"deletedById,omitempty" gorm:"type:char(36);"`
+	DeleteReason string     `json:"deleteReason,omitempty" gorm:"type:varchar(255);"`
+
+	// kept up to date on thread roots as replies come and go
+	ReplyCount        int        `json:"replyCount"`
+	ReplyParticipants int        `json:"replyParticipants"`
+	LastReplyAt       *time.Time `json:"lastReplyAt,omitempty"`
+
+	// reactions by emoji, tallied from the preloaded MessageReactions
+	Reactions        []Reaction        `json:"reactions,omitempty" gorm:"-"`
+	MessageReactions []MessageReaction `json:"-" gorm:"foreignKey:MessageID"`
+
+	// ids of the participants mentioned with @email, set when the message is saved
+	Mentions []uuid.UUID `json:"mentions,omitempty" gorm:"-"`
 }
 
 type MessageRead struct {
@@ -80,6 +105,7 @@ type MessageRead struct {
 	ReadAt    time.Time  `json:"readAt"`
 	User      users.User `json:"user" gorm:"foreignKey:UserID"`
 	UserID    uuid.UUID  `json:"userId" gorm:"type:char(36);uniqueIndex:idx_message_id_user_id"`
+	Seq       uint64     `json:"seq,omitempty" gorm:"index"`
 }
 
 type Attachment struct {
@@ -90,10 +116,34 @@ type Attachment struct {
 	Buffer       []byte
 }
 
+// Audience returns the ids of the users that can see a message; channel participants for channel
+// messages, otherwise the sender and recipient of a direct message
+func (msg Message) Audience() ([]uuid.UUID, error) {
+	if msg.ChannelID != nil {
+		return ChannelParticipantIDs(*msg.ChannelID)
+	}
+	ids := []uuid.UUID{msg.UserID}
+	if msg.RecipientID != nil && *msg.RecipientID != msg.UserID {
+		ids = append(ids, *msg.RecipientID)
+	}
+	return ids, nil
+}
+
+// MessageAudience looks up a message and returns the ids of the users that can see it
+func MessageAudience(messageID uuid.UUID) ([]uuid.UUID, error) {
+	var msg Message
+	err := server.DB.Select("id", "user_id", "recipient_id", "channel_id").
+		Where("id = ?", messageID).First(&msg).Error
+	if err != nil {
+		return nil, err
+	}
+	return msg.Audience()
+}
+
 func LoadChannelMessages(channelID uuid.UUID, since *time.Time, max int) (messages []Message, err error) {
 
 	err = server.DB.Debug().
-		Preload("User").Preload("Likes").
+		Preload("User").Preload("Likes").Preload("MessageReactions", liveReactions).
 		Find(&messages, "channel_id = ? ", channelID).
 		Limit(max).
 		Error
@@ -131,7 +181,7 @@ func GetChannelMessages(w http.ResponseWriter, r *http.Request) {
 	var messages []Message
 
 	if err := server.DB.Order("created_at").Where("channel_id = ? and (message_type = 'post' or message_type = 'system')", channelID).
-		Preload("User").Preload("Read").Preload("Tags").Preload("Likes").
+		Preload("User").Preload("Read").Preload("Tags").Preload("Likes").Preload("MessageReactions", liveReactions).
 		Preload("Replies", func(db *gorm.DB) *gorm.DB {
 			return server.DB.Where("channel_id = ? AND message_type = 'reply'", channelID)
 		}).
@@ -176,8 +226,8 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 
 	var messages []Message
 
-	stmt := server.DB.Preload("Channel").Preload("User").Preload("Tags").Preload("Likes").Order("created_at desc").
-		Where("message_type = 'post' AND channel_id IN (?)",
+	stmt := server.DB.Preload("Channel").Preload("User").Preload("Tags").Preload("Likes").Preload("MessageReactions", liveReactions).Order("created_at desc").
+		Where("message_type = 'post' AND deleted_at IS NULL AND channel_id IN (?)",
 			server.DB.Table("channel_participants").Select("channel_id").Where("user_id = ? AND created_by_id = ?", user.ID, user.ID)).
 		Limit(count)
 	if !before.IsZero() {
@@ -206,8 +256,8 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 func LoadMessages(ids []string) (messages []Message) {
 
 	count := 10
-	err := server.DB.Preload("Channel").Preload("User").Preload("Tags").Preload("Likes").Order("created_at desc").
-		Where("id IN (?)", ids).Limit(count).Find(&messages).Error
+	err := server.DB.Preload("Channel").Preload("User").Preload("Tags").Preload("Likes").Preload("MessageReactions", liveReactions).Order("created_at desc").
+		Where("id IN (?) AND deleted_at IS NULL", ids).Limit(count).Find(&messages).Error
 
 	if err != nil {
 		slog.Error("unable to load messages", slog.Any("err", err))
@@ -280,7 +330,64 @@ func GetMessage(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, message)
 }
 
-func SaveMessage(msg Message) (ret Message, err error) {
+// SaveMessage saves a message posted by a user. The author is always the user; new channel messages need
+// the user to be a participant of the channel, approved unless the channel is open, and existing messages
+// may only be edited by their author or a moderator of the channel.
+func SaveMessage(user users.User, msg Message) (ret Message, err error) {
+
+	if msg.ID == uuid.Nil {
+		msg = clientFields(msg)
+		msg.UserID, msg.Email = user.ID, user.Email
+		if msg.InReplyToID != nil {
+			if err = replyTo(user, &msg); err != nil {
+				return ret, err
+			}
+		}
+		if msg.ChannelID != nil {
+			if err = CanPost(user.ID, *msg.ChannelID); err != nil {
+				return ret, err
+			}
+		}
+	} else {
+		var orig Message
+		err = server.DB.Select("id", "user_id", "channel_id", "deleted_at").Where("id = ?", msg.ID).First(&orig).Error
+		if err != nil {
+			slog.Error("unable to load message to edit", slog.String("id", msg.ID.String()), slog.Any("err", err))
+			return ret, err
+		}
+		if orig.UserID != user.ID && (orig.ChannelID == nil || !IsModerator(user.ID, *orig.ChannelID)) {
+			return ret, ErrNotAuthor
+		}
+		if orig.DeletedAt != nil {
+			return ret, ErrMessageDeleted
+		}
+		if err = writable(orig.ChannelID); err != nil {
+			return ret, err
+		}
+	}
+	return saveMessage(user.ID, msg)
+}
+
+// clientFields keeps what clients may set on a new message, leaving out what the server keeps track of:
+// timestamps, tombstones, thread counters, system messages and associated records
+func clientFields(msg Message) Message {
+	messageType := msg.MessageType
+	if messageType == "system" {
+		messageType = ""
+	}
+	return Message{Title: msg.Title, Message: msg.Message, Location: msg.Location, Deadline: msg.Deadline,
+		RecipientID: msg.RecipientID, MessageType: messageType, PostingType: msg.PostingType,
+		InReplyToID: msg.InReplyToID, ChannelID: msg.ChannelID, Tags: msg.Tags, ExternalURL: msg.ExternalURL}
+}
+
+// SaveSystemMessage saves a message generated by the server on behalf of msg.UserID, without the checks
+// of SaveMessage
+func SaveSystemMessage(msg Message) (Message, error) {
+	msg.MessageType = "system"
+	return saveMessage(msg.UserID, msg)
+}
+
+func saveMessage(editorID uuid.UUID, msg Message) (ret Message, err error) {
 	//var id uuid.UUID
 	//var err error
 	log.Printf("saving message; %v", msg)
@@ -294,6 +401,9 @@ func SaveMessage(msg Message) (ret Message, err error) {
 		}
 	}
 	if msg.ID == uuid.Nil {
+		if msg.ChannelID == nil && msg.RecipientID == nil {
+			return ret, ErrNoTarget
+		}
 
 		// Does a channel exist? We autocreate a channel for new personal messages.
 		// We create a unique hash from both recipient_id and user_id and XOR together, if they are not equal.
@@ -326,6 +436,11 @@ func SaveMessage(msg Message) (ret Message, err error) {
 			h.Write(msg.ChannelID.Bytes())
 			hash := h.Sum(nil)
 			msg.UniqueID = hex.EncodeToString(hash)
+
+			msg.Seq, err = NextSequence(*msg.ChannelID)
+			if err != nil {
+				return ret, err
+			}
 		}
 
 		err = server.DB.Create(&msg).Error
@@ -334,6 +449,9 @@ func SaveMessage(msg Message) (ret Message, err error) {
 			slog.Error("unable to create new message", slog.Any("err", err))
 			return ret, err
 		}
+		if msg.InReplyToID != nil {
+			replied(msg)
+		}
 		ret = msg
 	} else {
 		log.Printf("updating existing message: %v", msg)
@@ -344,28 +462,55 @@ func SaveMessage(msg Message) (ret Message, err error) {
 			return ret, err
 		}
 
+		// keep what the message looked like, edits move the message to the end of the channel stream
+		now := time.Now()
+		if err = revise(orig, editorID, now); err != nil {
+			return ret, err
+		}
+
 		msgMod := orig
-		msgMod.MessageType = msg.MessageType
+		msgMod.EditedAt = &now
+		if orig.ChannelID != nil {
+			msgMod.Seq, err = NextSequence(*orig.ChannelID)
+			if err != nil {
+				return ret, err
+			}
+		}
+		// what kind of message it is doesn't change, edits only touch what revisions keep
+		msgMod.Title = msg.Title
 		msgMod.PostingType = msg.PostingType
 		msgMod.Message = msg.Message
 		msgMod.ExternalURL = msg.ExternalURL
 		msgMod.Tags = msg.Tags
 
-		err = server.DB.Unscoped().Where("message_id = ?", msg.ID).Delete(MessageTag{}).Error
-
-		if err != nil {
-			slog.Error("unable to update message", slog.Any("err", err))
-		}
-
-		err = server.DB.Session(&gorm.Session{FullSaveAssociations: true}).Updates(&msgMod).Error
-
+		err = server.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Unscoped().Where("message_id = ?", msg.ID).Delete(MessageTag{}).Error; err != nil {
+				return err
+			}
+			// edited columns are named, so that clearing a field is saved too
+			err := tx.Model(&msgMod).Select("title", "posting_type", "message", "external_url", "edited_at", "seq").
+				Updates(&msgMod).Error
+			if err != nil || len(msgMod.Tags) == 0 {
+				return err
+			}
+			for i := range msgMod.Tags {
+				msgMod.Tags[i].ID, msgMod.Tags[i].MessageID = 0, msgMod.ID
+			}
+			return tx.Create(&msgMod.Tags).Error
+		})
 		if err != nil {
 			slog.Error("unable to update message", slog.Any("err", err))
+			return ret, err
 		}
 
 		ret = msgMod
 	}
 
+	ret.Mentions, err = recordMentions(ret)
+	if err != nil {
+		slog.Error("unable to record mentions", slog.String("id", ret.ID.String()), slog.Any("err", err))
+	}
+
 	go IndexMessage(ret.ID, ret)
 
 	return ret, nil
@@ -0,0 +1,205 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"areo/go-chat-backend/utils"
+	"errors"
+	"github.com/anuragkumar19/binding"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// max number of pins in a channel
+const maxPins = 100
+
+var ErrTooManyPins = errors.New("channel has too many pins, unpin something first")
+
+// ChannelPin is a message, or a link to a web page, pinned to the top of a channel by a moderator. Links
+// keep the preview fetched when they were pinned.
+type ChannelPin struct {
+	server.Base
+	ChannelID  uuid.UUID      `json:"channelId" gorm:"type:char(36);uniqueIndex:pin_idx_channel_id_message_id"`
+	MessageID  *uuid.UUID     `json:"messageId,omitempty" gorm:"type:char(36);uniqueIndex:pin_idx_channel_id_message_id"`
+	Message    *Message       `json:"message,omitempty" gorm:"foreignKey:MessageID"`
+	Preview    *utils.Preview `json:"preview,omitempty" gorm:"serializer:json"`
+	PinnedByID uuid.UUID      `json:"pinnedById" gorm:"type:char(36);"`
+	PinnedAt   time.Time      `json:"pinnedAt"`
+}
+
+// channelMember checks that the user is an approved participant of the channel in the url
+func channelMember(w http.ResponseWriter, r *http.Request, user users.User) (channelID uuid.UUID, ok bool) {
+	channelID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	ids, err := ChannelParticipantIDs(channelID)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	if !slices.Contains(ids, user.ID) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"status": "error", "err": ErrNotParticipant.Error()})
+		return
+	}
+	return channelID, true
+}
+
+// GetPins lists the pins of a channel, most recent first
+func GetPins(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, ok := channelMember(w, r, user)
+	if !ok {
+		return
+	}
+
+	pins := []ChannelPin{}
+	err := server.DB.Preload("Message").Preload("Message.User").Where("channel_id = ?", channelID).
+		Order("pinned_at desc").Find(&pins).Error
+	if err != nil {
+		slog.Error("unable to load pins", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, pins)
+}
+
+// PinPosting pins a message of the channel, or a link, with a {"messageId": "..."} or {"url": "..."} body
+func PinPosting(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	if !IsModerator(user.ID, channelID) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"status": "error", "err": "only moderators can pin"})
+		return
+	}
+	if err := writable(&channelID); err != nil {
+		roleError(w, r, err)
+		return
+	}
+
+	type param struct {
+		MessageID *uuid.UUID `json:"messageId" binding:""`
+		Url       string     `json:"url" binding:""`
+	}
+	pinParam := param{}
+	if err := binding.Bind(r, &pinParam); err != nil || (pinParam.MessageID == nil) == (pinParam.Url == "") {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"status": "fail", "err": "pin either a messageId or a url"})
+		return
+	}
+
+	pin := ChannelPin{ChannelID: channelID, PinnedByID: user.ID, PinnedAt: time.Now()}
+	if pinParam.MessageID != nil {
+		var msg Message
+		err = server.DB.Preload("User").Where("id = ? AND channel_id = ? AND deleted_at IS NULL", *pinParam.MessageID, channelID).
+			First(&msg).Error
+		if err != nil {
+			render.Status(r, http.StatusNotFound)
+			render.JSON(w, r, render.M{"status": "error", "err": "no such message in this channel"})
+			return
+		}
+		pin.MessageID, pin.Message = &msg.ID, &msg
+	} else {
+		// a link that can't be previewed is pinned as is
+		preview, err := utils.FetchPreview(pinParam.Url)
+		if err != nil || preview.Url == "" {
+			preview = utils.Preview{Url: pinParam.Url}
+		}
+		pin.Preview = &preview
+	}
+
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&ChannelPin{}).Where("channel_id = ?", channelID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= maxPins {
+			return ErrTooManyPins
+		}
+		if pin.MessageID != nil {
+			// pinning a pinned message again moves it to the top
+			err := tx.Where("channel_id = ? AND message_id = ?", channelID, *pin.MessageID).Delete(&ChannelPin{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Omit("Message").Create(&pin).Error
+	})
+	if errors.Is(err, ErrTooManyPins) {
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	} else if err != nil {
+		slog.Error("unable to pin", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	emit(Event{Type: "pin", UserID: user.ID, Pin: &pin})
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, pin)
+}
+
+// UnpinPosting removes a pin from a channel
+func UnpinPosting(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	pinID, err := uuid.FromString(chi.URLParam(r, "pinId"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	if !IsModerator(user.ID, channelID) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"status": "error", "err": "only moderators can unpin"})
+		return
+	}
+	if err := writable(&channelID); err != nil {
+		roleError(w, r, err)
+		return
+	}
+
+	var pin ChannelPin
+	err = server.DB.Where("id = ? AND channel_id = ?", pinID, channelID).First(&pin).Error
+	if err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	err = server.DB.Delete(&pin).Error
+	if err != nil {
+		slog.Error("unable to unpin", slog.String("pinID", pinID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	emit(Event{Type: "unpin", UserID: user.ID, Pin: &pin})
+	render.JSON(w, r, render.M{"status": "OK"})
+}
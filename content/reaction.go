@@ -0,0 +1,238 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"errors"
+	"github.com/anuragkumar19/binding"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultReaction is what a like, or a reaction without an emoji, turns into
+const DefaultReaction = "👍"
+
+const maxEmojiLength = 64
+
+var ErrInvalidEmoji = errors.New("reactions need an emoji of at most 64 bytes")
+
+// MessageReaction is an emoji reaction of a user to a message. Users can react with any number of
+// emojis. Removing a reaction keeps the row, with RemovedAt set and a new sequence number, so the
+// removal is replayed to clients that missed it.
+type MessageReaction struct {
+	server.Base
+	MessageID uuid.UUID  `json:"messageId" gorm:"type:char(36);uniqueIndex:reaction_idx_message_id_user_id_emoji"`
+	UserID    uuid.UUID  `json:"userId" gorm:"type:char(36);uniqueIndex:reaction_idx_message_id_user_id_emoji"`
+	Emoji     string     `json:"emoji" gorm:"type:varchar(64);uniqueIndex:reaction_idx_message_id_user_id_emoji"`
+	ReactedAt time.Time  `json:"reactedAt"`
+	RemovedAt *time.Time `json:"removedAt,omitempty"`
+	Seq       uint64     `json:"seq,omitempty" gorm:"index"`
+}
+
+// Reaction is the tally of one emoji on a message
+type Reaction struct {
+	Emoji   string      `json:"emoji"`
+	Count   int         `json:"count"`
+	UserIDs []uuid.UUID `json:"userIds"`
+}
+
+// liveReactions preloads the reactions of messages that haven't been removed, for summarizing
+func liveReactions(db *gorm.DB) *gorm.DB {
+	return db.Where("removed_at IS NULL").Order("reacted_at")
+}
+
+// AfterFind tallies the preloaded reactions of a message by emoji, in the order they were first used
+func (msg *Message) AfterFind(tx *gorm.DB) error {
+	if msg.MessageReactions == nil {
+		return nil
+	}
+	msg.Reactions = []Reaction{}
+	for _, v := range msg.MessageReactions {
+		if v.RemovedAt != nil {
+			continue
+		}
+		i := slices.IndexFunc(msg.Reactions, func(r Reaction) bool { return r.Emoji == v.Emoji })
+		if i < 0 {
+			msg.Reactions = append(msg.Reactions, Reaction{Emoji: v.Emoji})
+			i = len(msg.Reactions) - 1
+		}
+		msg.Reactions[i].Count++
+		msg.Reactions[i].UserIDs = append(msg.Reactions[i].UserIDs, v.UserID)
+	}
+	return nil
+}
+
+// React adds or removes a reaction of a user to a message the user can see. Adding a reaction that is
+// there, or removing one that isn't, changes nothing and returns it as is, with changed false.
+func React(messageID uuid.UUID, userID uuid.UUID, emoji string, remove bool) (reaction MessageReaction, changed bool, err error) {
+
+	if emoji == "" {
+		emoji = DefaultReaction
+	}
+	if len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return reaction, false, ErrInvalidEmoji
+	}
+
+	audience, err := MessageAudience(messageID)
+	if err != nil {
+		return reaction, false, err
+	}
+	if !slices.Contains(audience, userID) {
+		return reaction, false, ErrNotParticipant
+	}
+	channelID, err := MessageChannelID(messageID)
+	if err == nil {
+		err = writable(channelID)
+	}
+	if err != nil {
+		return reaction, false, err
+	}
+
+	err = server.DB.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji).
+		Limit(1).Find(&reaction).Error
+	if err != nil {
+		slog.Error("unable to load reaction", slog.String("messageID", messageID.String()), slog.Any("err", err))
+		return
+	}
+	exists := reaction.ID != uuid.Nil
+	if !exists {
+		reaction.MessageID, reaction.UserID, reaction.Emoji = messageID, userID, emoji
+	}
+	if remove && (!exists || reaction.RemovedAt != nil) || !remove && exists && reaction.RemovedAt == nil {
+		return reaction, false, nil
+	}
+
+	now := time.Now()
+	if remove {
+		reaction.RemovedAt = &now
+	} else {
+		reaction.ReactedAt, reaction.RemovedAt = now, nil
+	}
+
+	_, reaction.Seq, err = messageSequence(messageID)
+	if err != nil {
+		slog.Error("unable to store reaction", slog.String("error", err.Error()))
+		return
+	}
+
+	if exists {
+		err = server.DB.Model(&reaction).Select("reacted_at", "removed_at", "seq").Updates(&reaction).Error
+	} else {
+		// racing reactions by the same user end up on the same row
+		err = server.DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "message_id"}, {Name: "user_id"}, {Name: "emoji"}},
+			DoUpdates: clause.AssignmentColumns([]string{"reacted_at", "removed_at", "seq", "updated_at"}),
+		}).Create(&reaction).Error
+	}
+	if err != nil {
+		slog.Error("unable to store reaction", slog.String("error", err.Error()))
+		return
+	}
+	return reaction, true, nil
+}
+
+// migrateLikes turns the likes from before reactions into default reactions
+func migrateLikes() {
+	var likes []MessageLike
+	err := server.DB.Where("NOT EXISTS (SELECT 1 FROM message_reactions r "+
+		"WHERE r.message_id = message_likes.message_id AND r.user_id = message_likes.user_id AND r.emoji = ?)",
+		DefaultReaction).Find(&likes).Error
+	if err == nil && len(likes) > 0 {
+		reactions := make([]MessageReaction, len(likes))
+		for i, like := range likes {
+			reactions[i] = MessageReaction{MessageID: like.MessageID, UserID: like.UserID, Emoji: DefaultReaction,
+				ReactedAt: like.LikeAt}
+		}
+		err = server.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&reactions).Error
+	}
+	if err != nil {
+		slog.Error("unable to migrate likes", slog.Any("err", err))
+	}
+}
+
+// reactionError answers a failed reaction
+func reactionError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidEmoji):
+		render.Status(r, http.StatusBadRequest)
+	case errors.Is(err, ErrNotParticipant), errors.Is(err, ErrChannelArchived):
+		render.Status(r, http.StatusForbidden)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		render.Status(r, http.StatusNotFound)
+	default:
+		render.Status(r, http.StatusInternalServerError)
+	}
+	render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+}
+
+// AddReaction reacts to a message with the emoji in a {"emoji": "..."} body
+func AddReaction(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusPreconditionFailed)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	type param struct {
+		Emoji string `json:"emoji" binding:""`
+	}
+	reactionParam := param{}
+	if err := binding.Bind(r, &reactionParam); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"status": "fail",
+			"err": err.Error() + " - Check JSON body input is not malformed"})
+		return
+	}
+
+	reaction, changed, err := React(id, user.ID, reactionParam.Emoji, false)
+	if err != nil {
+		reactionError(w, r, err)
+		return
+	}
+	if changed {
+		emit(Event{Type: "react", UserID: user.ID, Reaction: &reaction})
+	}
+	render.JSON(w, r, reaction)
+}
+
+// RemoveReaction takes back a reaction of the user, by the url escaped emoji
+func RemoveReaction(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusPreconditionFailed)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	emoji, err := url.PathUnescape(chi.URLParam(r, "emoji"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	reaction, changed, err := React(id, user.ID, emoji, true)
+	if err != nil {
+		reactionError(w, r, err)
+		return
+	}
+	if changed {
+		emit(Event{Type: "react", UserID: user.ID, Reaction: &reaction})
+	}
+	render.JSON(w, r, render.M{"status": "OK"})
+}
@@ -0,0 +1,76 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// MessageRevision is what a message looked like before an edit, and who edited it when
+type MessageRevision struct {
+	server.Base
+	MessageID   uuid.UUID  `json:"messageId" gorm:"type:char(36);index"`
+	EditorID    uuid.UUID  `json:"editorId" gorm:"type:char(36);"`
+	Editor      users.User `json:"editor" gorm:"foreignKey:EditorID"`
+	EditedAt    time.Time  `json:"editedAt"`
+	Title       string     `json:"title"`
+	Message     string     `json:"message"`
+	ExternalURL string     `json:"externalUrl" gorm:"type:char(255)"`
+	PostingType string     `json:"postingType" gorm:"type:char(36);"`
+	Tags        []string   `json:"tags" gorm:"serializer:json"`
+}
+
+// revise records the current state of a message as a revision, before it is overwritten by an edit
+func revise(orig Message, editorID uuid.UUID, editedAt time.Time) error {
+	revision := MessageRevision{MessageID: orig.ID, EditorID: editorID, EditedAt: editedAt,
+		Title: orig.Title, Message: orig.Message, ExternalURL: orig.ExternalURL, PostingType: orig.PostingType, Tags: make([]string, 0, len(orig.Tags))}
+	for _, v := range orig.Tags {
+		revision.Tags = append(revision.Tags, v.Tag)
+	}
+
+	err := server.DB.Create(&revision).Error
+	if err != nil {
+		slog.Error("unable to store message revision", slog.String("messageID", orig.ID.String()), slog.Any("err", err))
+	}
+	return err
+}
+
+// GetMessageRevisions lists the earlier versions of a message, oldest first, to those who can see the message
+func GetMessageRevisions(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+
+	audience, err := MessageAudience(id)
+	if err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	if !slices.Contains(audience, user.ID) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"status": "error", "err": "not allowed to see this message"})
+		return
+	}
+
+	revisions := []MessageRevision{}
+	err = server.DB.Preload("Editor").Where("message_id = ?", id).Order("edited_at").Find(&revisions).Error
+	if err != nil {
+		slog.Error("unable to load message revisions", slog.String("messageID", id.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, revisions)
+}
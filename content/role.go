@@ -0,0 +1,215 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"errors"
+	"github.com/anuragkumar19/binding"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// roles of the participants of a channel. Owners and moderators moderate the channel; they approve and
+// remove members, edit the channel, and edit, delete and pin messages. Only owners delete the channel,
+// and change the role of moderators.
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+var (
+	ErrNotModerator = errors.New("only moderators of the channel can do this")
+	ErrNotOwner     = errors.New("only the owner of the channel can do this")
+	ErrOwnerNeeded  = errors.New("a channel needs an owner, hand over ownership first")
+	ErrInvalidRole  = errors.New("role must be owner, moderator or member")
+)
+
+// ChannelRole returns the role of an approved participant of a channel, or an empty string for anyone else
+func ChannelRole(userID uuid.UUID, channelID uuid.UUID) string {
+	var participant ChannelParticipant
+	err := server.DB.Select("role").Where("channel_id = ? AND user_id = ? AND approved = ?", channelID, userID, true).
+		Limit(1).Find(&participant).Error
+	if err != nil {
+		slog.Error("unable to look up channel role", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return ""
+	}
+	return participant.Role
+}
+
+// IsModerator tells whether a user moderates a channel, as its owner or one of its moderators
+func IsModerator(userID uuid.UUID, channelID uuid.UUID) bool {
+	role := ChannelRole(userID, channelID)
+	return role == RoleOwner || role == RoleModerator
+}
+
+// CanManageMember checks that a user may add or remove a member of a channel. Anyone may leave a channel
+// but its owner, moderators manage members, and only owners manage moderators.
+func CanManageMember(actorID uuid.UUID, channelID uuid.UUID, userID uuid.UUID) error {
+	target := ChannelRole(userID, channelID)
+	if actorID == userID {
+		if target == RoleOwner {
+			return ErrOwnerNeeded
+		}
+		return nil
+	}
+
+	actor := ChannelRole(actorID, channelID)
+	if actor != RoleOwner && actor != RoleModerator {
+		return ErrNotModerator
+	}
+	if target == RoleOwner || target == RoleModerator && actor != RoleOwner {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// SetRole changes the role of an approved participant of a channel. Moderators promote members, owners
+// also demote moderators, and hand over ownership by making someone else owner, which leaves them moderator.
+func SetRole(actorID uuid.UUID, channelID uuid.UUID, userID uuid.UUID, role string) (participant ChannelParticipant, err error) {
+	if !slices.Contains([]string{RoleOwner, RoleModerator, RoleMember}, role) {
+		return participant, ErrInvalidRole
+	}
+
+	actor := ChannelRole(actorID, channelID)
+	if actor != RoleOwner && actor != RoleModerator {
+		return participant, ErrNotModerator
+	}
+
+	err = server.DB.Where("channel_id = ? AND user_id = ? AND approved = ?", channelID, userID, true).First(&participant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return participant, ErrNotParticipant
+	} else if err != nil {
+		return
+	}
+	if participant.Role == role {
+		return participant, nil
+	}
+
+	switch {
+	case participant.Role == RoleOwner:
+		return participant, ErrOwnerNeeded
+	case actorID == userID && role == RoleMember:
+		// moderators may step down
+	case role == RoleOwner || participant.Role == RoleModerator:
+		if actor != RoleOwner {
+			return participant, ErrNotOwner
+		}
+	}
+
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		if role == RoleOwner {
+			err := tx.Model(&ChannelParticipant{}).Where("channel_id = ? AND user_id = ?", channelID, actorID).
+				Update("role", RoleModerator).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(&ChannelParticipant{}).Where("channel_id = ? AND user_id = ?", channelID, userID).
+			Update("role", role).Error
+	})
+	if err != nil {
+		slog.Error("unable to change role", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return
+	}
+	participant.Role = role
+	return
+}
+
+// roleError answers a request the user wasn't allowed to make in a channel
+func roleError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidRole):
+		render.Status(r, http.StatusBadRequest)
+	case errors.Is(err, ErrNotModerator), errors.Is(err, ErrNotOwner), errors.Is(err, ErrOwnerNeeded),
+		errors.Is(err, ErrChannelArchived):
+		render.Status(r, http.StatusForbidden)
+	case errors.Is(err, ErrNotParticipant):
+		render.Status(r, http.StatusNotFound)
+	default:
+		render.Status(r, http.StatusInternalServerError)
+	}
+	render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+}
+
+// GetMembers lists the participants of a channel with their roles, pending ones included for moderators
+func GetMembers(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, ok := channelMember(w, r, user)
+	if !ok {
+		return
+	}
+
+	stmt := server.DB.Where("channel_id = ?", channelID)
+	if !IsModerator(user.ID, channelID) {
+		stmt = stmt.Where("approved = ?", true)
+	}
+	members := []ChannelParticipant{}
+	if err := stmt.Order("created_at").Find(&members).Error; err != nil {
+		slog.Error("unable to load members", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, members)
+}
+
+// SetMemberRole promotes or demotes a member of a channel, with a {"role": "owner|moderator|member"} body
+func SetMemberRole(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	channelID, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+	userID, err := uuid.FromString(chi.URLParam(r, "userId"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+
+	type param struct {
+		Role string `json:"role" binding:""`
+	}
+	roleParam := param{}
+	if err := binding.Bind(r, &roleParam); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"status": "fail",
+			"err": err.Error() + " - Check JSON body input is not malformed"})
+		return
+	}
+
+	participant, err := SetRole(user.ID, channelID, userID, roleParam.Role)
+	if err != nil {
+		roleError(w, r, err)
+		return
+	}
+	render.JSON(w, r, participant)
+}
+
+// migrateModerators makes owners of the moderators of channels created before participants had roles,
+// the creator being the only moderator a channel got, and drops the table they were kept in
+func migrateModerators() {
+	if !server.DB.Migrator().HasTable("channel_moderators") {
+		return
+	}
+	err := server.DB.Model(&ChannelParticipant{}).
+		Where("EXISTS (SELECT 1 FROM channel_moderators m "+
+			"WHERE m.channel_id = channel_participants.channel_id AND m.user_id = channel_participants.user_id)").
+		Update("role", RoleOwner).Error
+	if err == nil {
+		err = server.DB.Migrator().DropTable("channel_moderators")
+	}
+	if err != nil {
+		slog.Error("unable to migrate channel moderators", slog.Any("err", err))
+	}
+}
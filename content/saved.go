@@ -0,0 +1,220 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"areo/go-chat-backend/utils"
+	"errors"
+	"github.com/anuragkumar19/binding"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// max number of reminders sent in one go, the rest wait for the next round
+const maxDueReminders = 100
+
+// SavedMessage is a message a user saved for later, optionally with a time to be reminded of it
+type SavedMessage struct {
+	server.Base
+	UserID     uuid.UUID  `json:"userId" gorm:"type:char(36);uniqueIndex:saved_idx_user_id_message_id"`
+	MessageID  uuid.UUID  `json:"messageId" gorm:"type:char(36);uniqueIndex:saved_idx_user_id_message_id"`
+	Message    *Message   `json:"message,omitempty" gorm:"foreignKey:MessageID"`
+	RemindAt   *time.Time `json:"remindAt,omitempty" gorm:"index"`
+	RemindedAt *time.Time `json:"remindedAt,omitempty"`
+}
+
+// SaveMessageForLater saves a message the user can see, or changes when to be reminded of a saved one.
+// A nil remindAt saves it without a reminder.
+func SaveMessageForLater(userID uuid.UUID, messageID uuid.UUID, remindAt *time.Time) (saved SavedMessage, err error) {
+	audience, err := MessageAudience(messageID)
+	if err != nil {
+		return saved, err
+	}
+	if !slices.Contains(audience, userID) {
+		return saved, ErrNotParticipant
+	}
+
+	saved = SavedMessage{UserID: userID, MessageID: messageID, RemindAt: remindAt}
+	err = server.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "message_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"remind_at": remindAt, "reminded_at": nil, "updated_at": time.Now()}),
+	}).Create(&saved).Error
+	if err != nil {
+		slog.Error("unable to save message", slog.String("messageID", messageID.String()), slog.Any("err", err))
+		return
+	}
+	// on conflict, saved holds a new id rather than the one of the row that was updated
+	var stored SavedMessage
+	err = server.DB.Where("user_id = ? AND message_id = ?", userID, messageID).First(&stored).Error
+	return stored, err
+}
+
+// DueReminders claims the saved messages whose reminder is due, so that every reminder is sent once
+// even with several instances checking
+func DueReminders(now time.Time) (due []SavedMessage, err error) {
+	var candidates []SavedMessage
+	err = server.DB.Preload("Message").Where("remind_at <= ? AND reminded_at IS NULL", now).
+		Order("remind_at").Limit(maxDueReminders).Find(&candidates).Error
+	if err != nil {
+		slog.Error("unable to load due reminders", slog.Any("err", err))
+		return
+	}
+	for _, saved := range candidates {
+		claim := server.DB.Model(&SavedMessage{}).Where("id = ? AND reminded_at IS NULL", saved.ID).Update("reminded_at", now)
+		if claim.Error != nil {
+			slog.Error("unable to claim reminder", slog.String("id", saved.ID.String()), slog.Any("err", claim.Error))
+			continue
+		}
+		if claim.RowsAffected == 1 {
+			saved.RemindedAt = &now
+			due = append(due, saved)
+		}
+	}
+	return
+}
+
+// Remind records a reminder of a saved message as a system message to the user, in their conversation
+// with themselves. Messages that were deleted, or that the user can no longer see, are skipped. Reminders
+// that fail are released, to be sent in a later round.
+func Remind(saved SavedMessage) (msg Message, ok bool, err error) {
+	if saved.Message == nil || saved.Message.DeletedAt != nil {
+		return msg, false, nil
+	}
+	audience, err := saved.Message.Audience()
+	if err != nil {
+		release(saved)
+		return msg, false, err
+	}
+	if !slices.Contains(audience, saved.UserID) {
+		return msg, false, nil
+	}
+
+	msg, err = SaveSystemMessage(Message{UserID: saved.UserID, RecipientID: &saved.UserID, SystemFlags: "reminder",
+		Title: saved.Message.Title, Message: saved.Message.Message, ExternalURL: saved.Message.ExternalURL})
+	if err != nil {
+		slog.Error("unable to send reminder", slog.String("id", saved.ID.String()), slog.Any("err", err))
+		release(saved)
+		return msg, false, err
+	}
+	return msg, true, nil
+}
+
+// release gives up the claim on a reminder, so that it is due again
+func release(saved SavedMessage) {
+	err := server.DB.Model(&SavedMessage{}).Where("id = ?", saved.ID).Update("reminded_at", nil).Error
+	if err != nil {
+		slog.Error("unable to release reminder", slog.String("id", saved.ID.String()), slog.Any("err", err))
+	}
+}
+
+// visibleMessages selects the ids of the messages a user can currently see, like Message.Audience does
+func visibleMessages(userID uuid.UUID) *gorm.DB {
+	return server.DB.Model(&Message{}).Select("id").
+		Where("(channel_id IS NULL AND (user_id = ? OR recipient_id = ?)) OR channel_id IN (?)", userID, userID,
+			server.DB.Table("channel_participants").Select("channel_id").Where("user_id = ? AND approved = ?", userID, true))
+}
+
+// SavePosting saves a message for later, with an optional {"remindAt": "<RFC 3339 time>"} body
+func SavePosting(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+
+	type param struct {
+		RemindAt *time.Time `json:"remindAt" binding:""`
+	}
+	saveParam := param{}
+	if r.ContentLength != 0 {
+		if err := binding.Bind(r, &saveParam); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, render.M{"status": "fail",
+				"err": err.Error() + " - Check JSON body input is not malformed"})
+			return
+		}
+	}
+
+	saved, err := SaveMessageForLater(user.ID, id, saveParam.RemindAt)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	} else if errors.Is(err, ErrNotParticipant) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	} else if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, saved)
+}
+
+// UnsavePosting removes a message from the saved messages of the user
+func UnsavePosting(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+
+	err = server.DB.Where("user_id = ? AND message_id = ?", user.ID, id).Delete(&SavedMessage{}).Error
+	if err != nil {
+		slog.Error("unable to unsave message", slog.String("messageID", id.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, render.M{"status": "OK"})
+}
+
+// GetSavedMessages lists the saved messages of the user that they can still see, most recently saved first,
+// by ?page= and ?pageSize=
+func GetSavedMessages(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	page := utils.DefaultQuery(r, "page", 0)
+	pageSize := utils.DefaultQuery(r, "pageSize", 30)
+	if page < 0 {
+		page = 0
+	}
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 100
+	}
+
+	saved := []SavedMessage{}
+	var totalCount int64
+	// messages of channels the user has left since saving them are kept, but not shown
+	visible := visibleMessages(user.ID)
+	err := server.DB.Model(&SavedMessage{}).Where("user_id = ? AND message_id IN (?)", user.ID, visible).Count(&totalCount).Error
+	if err == nil {
+		err = server.DB.Preload("Message").Preload("Message.User").Preload("Message.MessageReactions", liveReactions).
+			Where("user_id = ? AND message_id IN (?)", user.ID, visible).Order("created_at desc").Limit(pageSize).Offset(page * pageSize).Find(&saved).Error
+	}
+	if err != nil {
+		slog.Error("unable to load saved messages", slog.String("userID", user.ID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	pageCount := int(math.Ceil(float64(totalCount) / float64(pageSize)))
+	render.JSON(w, r, render.M{"items": saved, "totalCount": totalCount, "page": page, "pageSize": pageSize, "offset": page * pageSize, "pageCount": pageCount})
+}
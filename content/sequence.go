@@ -0,0 +1,156 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log/slog"
+	"time"
+)
+
+// ChannelSequence holds the last sequence number handed out for a channel. Everything persisted to the
+// stream of a channel - messages, edits, reactions and reads - gets the next number, so clients can tell what
+// they missed. An edited message takes a new number, so the edit is replayed rather than the original.
+type ChannelSequence struct {
+	ChannelID uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Seq       uint64
+}
+
+// ChannelAck is the last sequence number of a channel a user has acknowledged processing
+type ChannelAck struct {
+	ChannelID uuid.UUID `json:"channelId" gorm:"type:char(36);primaryKey"`
+	UserID    uuid.UUID `json:"userId" gorm:"type:char(36);primaryKey"`
+	Seq       uint64    `json:"seq"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ChannelEvents are the messages, reactions and reads of a channel past a given sequence number
+type ChannelEvents struct {
+	Messages  []Message
+	Reactions []MessageReaction
+	Reads     []MessageRead
+}
+
+// Len returns the total number of events
+func (e ChannelEvents) Len() int {
+	return len(e.Messages) + len(e.Reactions) + len(e.Reads)
+}
+
+// NextSequence hands out the next sequence number for a channel
+func NextSequence(channelID uuid.UUID) (seq uint64, err error) {
+
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ChannelSequence{ChannelID: channelID}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&ChannelSequence{}).Where("channel_id = ?", channelID).
+			Update("seq", gorm.Expr("seq + 1")).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&ChannelSequence{}).Select("seq").Where("channel_id = ?", channelID).Row().Scan(&seq)
+	})
+
+	if err != nil {
+		slog.Error("unable to assign sequence number", slog.String("channelID", channelID.String()), slog.Any("err", err))
+	}
+	return
+}
+
+// messageSequence hands out the next sequence number for the channel a message was posted in. Direct
+// messages aren't part of a channel stream and get no sequence number.
+func messageSequence(messageID uuid.UUID) (channelID *uuid.UUID, seq uint64, err error) {
+	channelID, err = MessageChannelID(messageID)
+	if err != nil || channelID == nil {
+		return channelID, 0, err
+	}
+	seq, err = NextSequence(*channelID)
+	return
+}
+
+// MessageChannelID returns the channel a message was posted in, nil for direct messages
+func MessageChannelID(messageID uuid.UUID) (*uuid.UUID, error) {
+	var msg Message
+	err := server.DB.Select("id", "channel_id").Where("id = ?", messageID).First(&msg).Error
+	if err != nil {
+		return nil, err
+	}
+	return msg.ChannelID, nil
+}
+
+// Ack records that a user has processed a channel up to the given sequence number. Acks never move backwards.
+func Ack(channelID, userID uuid.UUID, seq uint64) error {
+
+	ack := ChannelAck{ChannelID: channelID, UserID: userID, Seq: seq, UpdatedAt: time.Now()}
+
+	err := server.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ack).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&ChannelAck{}).Where("channel_id = ? AND user_id = ? AND seq < ?", channelID, userID, seq).
+			Updates(map[string]interface{}{"seq": seq, "updated_at": ack.UpdatedAt}).Error
+	})
+
+	if err != nil {
+		slog.Error("unable to store ack", slog.String("channelID", channelID.String()), slog.Any("err", err))
+	}
+	return err
+}
+
+// LoadAcks returns the acknowledged sequence number of every channel the user has acked
+func LoadAcks(userID uuid.UUID) (acks map[uuid.UUID]uint64, err error) {
+	var rows []ChannelAck
+	err = server.DB.Where("user_id = ?", userID).Find(&rows).Error
+	if err != nil {
+		slog.Error("unable to load acks", slog.String("userID", userID.String()), slog.Any("err", err))
+		return nil, err
+	}
+
+	acks = make(map[uuid.UUID]uint64, len(rows))
+	for _, v := range rows {
+		acks[v.ChannelID] = v.Seq
+	}
+	return
+}
+
+// EventsSince loads what happened in a channel after the given sequence number, at most max of each kind
+func EventsSince(channelID uuid.UUID, seq uint64, max int) (events ChannelEvents, err error) {
+
+	err = server.DB.Preload("User").Preload("Tags").Preload("MessageReactions", liveReactions).
+		Where("channel_id = ? AND seq > ?", channelID, seq).
+		Order("seq").Limit(max).Find(&events.Messages).Error
+	if err != nil {
+		slog.Error("unable to load messages since", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return
+	}
+
+	inChannel := server.DB.Model(&Message{}).Select("id").Where("channel_id = ?", channelID)
+
+	err = server.DB.Where("seq > ? AND message_id IN (?)", seq, inChannel).
+		Order("seq").Limit(max).Find(&events.Reactions).Error
+	if err != nil {
+		slog.Error("unable to load reactions since", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return
+	}
+
+	err = server.DB.Where("seq > ? AND message_id IN (?)", seq, inChannel).
+		Order("seq").Limit(max).Find(&events.Reads).Error
+	if err != nil {
+		slog.Error("unable to load reads since", slog.String("channelID", channelID.String()), slog.Any("err", err))
+	}
+	return
+}
+
+// UserChannelIDs returns the ids of the channels a user is an approved participant of
+func UserChannelIDs(userID uuid.UUID) (ids []uuid.UUID, err error) {
+	err = server.DB.Model(&ChannelParticipant{}).
+		Where("user_id = ? AND approved = ?", userID, true).
+		Pluck("channel_id", &ids).Error
+	if err != nil {
+		slog.Error("unable to load channels of user", slog.String("userID", userID.String()), slog.Any("err", err))
+	}
+	return
+}
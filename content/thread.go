@@ -0,0 +1,275 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"areo/go-chat-backend/utils"
+	"errors"
+	"github.com/anuragkumar19/binding"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	threadPageSize    = 50
+	maxThreadPageSize = 200
+)
+
+// ThreadSubscription is where a user is in a thread; whether they follow it, being told about new
+// replies, and up to when they have read it. Authors of the root message and of replies follow the
+// thread until they unfollow it.
+type ThreadSubscription struct {
+	ThreadID  uuid.UUID  `json:"threadId" gorm:"type:char(36);primaryKey"`
+	UserID    uuid.UUID  `json:"userId" gorm:"type:char(36);primaryKey"`
+	Following bool       `json:"following"`
+	ReadAt    *time.Time `json:"readAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+// threadParent looks up the message a reply is posted to, moving on to the root of its thread when that
+// message is itself a reply, so threads stay one level deep
+func threadParent(id uuid.UUID) (parent Message, err error) {
+	err = server.DB.Select("id", "user_id", "recipient_id", "channel_id", "in_reply_to_id", "deleted_at").
+		Where("id = ?", id).First(&parent).Error
+	if err == nil && parent.InReplyToID != nil {
+		return threadParent(*parent.InReplyToID)
+	}
+	return
+}
+
+// replyTo places a new reply in the thread of the message it replies to; in its channel, or in the
+// direct conversation it belongs to
+func replyTo(user users.User, msg *Message) error {
+	parent, err := threadParent(*msg.InReplyToID)
+	if err != nil {
+		return err
+	}
+	if parent.DeletedAt != nil {
+		return ErrMessageDeleted
+	}
+
+	msg.InReplyToID, msg.ChannelID, msg.RecipientID = &parent.ID, parent.ChannelID, nil
+	if parent.ChannelID == nil {
+		audience, _ := parent.Audience()
+		if !slices.Contains(audience, user.ID) {
+			return ErrNotParticipant
+		}
+		msg.RecipientID = parent.RecipientID
+		if parent.UserID != user.ID {
+			msg.RecipientID = &parent.UserID
+		}
+	}
+	return nil
+}
+
+// replied updates the thread a reply was posted to; its counts, the reply author reading and following
+// it, and the root author following it
+func replied(reply Message) {
+	threadID := *reply.InReplyToID
+	updateThreadStats(threadID)
+
+	var root Message
+	err := server.DB.Select("id", "user_id").Where("id = ?", threadID).First(&root).Error
+	if err == nil {
+		server.DB.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&ThreadSubscription{ThreadID: threadID, UserID: root.UserID, Following: true})
+	}
+
+	readAt := reply.CreatedAt
+	err = server.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "thread_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"read_at", "updated_at"}),
+	}).Create(&ThreadSubscription{ThreadID: threadID, UserID: reply.UserID, Following: true, ReadAt: &readAt}).Error
+	if err != nil {
+		slog.Error("unable to update thread subscription", slog.String("threadID", threadID.String()), slog.Any("err", err))
+	}
+}
+
+// updateThreadStats counts the live replies of a thread and their authors, and when the last was posted
+func updateThreadStats(threadID uuid.UUID) {
+	replies := server.DB.Model(&Message{}).Where("in_reply_to_id = ? AND deleted_at IS NULL", threadID)
+
+	var count, participants int64
+	var last Message
+	err := replies.Session(&gorm.Session{}).Count(&count).Error
+	if err == nil {
+		err = replies.Session(&gorm.Session{}).Distinct("user_id").Count(&participants).Error
+	}
+	if err == nil && count > 0 {
+		err = replies.Session(&gorm.Session{}).Select("created_at").Order("created_at desc").First(&last).Error
+	}
+	if err != nil {
+		slog.Error("unable to count replies", slog.String("threadID", threadID.String()), slog.Any("err", err))
+		return
+	}
+
+	stats := map[string]interface{}{"reply_count": count, "reply_participants": participants, "last_reply_at": nil}
+	if count > 0 {
+		stats["last_reply_at"] = last.CreatedAt
+	}
+	err = server.DB.Model(&Message{}).Where("id = ?", threadID).Updates(stats).Error
+	if err != nil {
+		slog.Error("unable to update thread", slog.String("threadID", threadID.String()), slog.Any("err", err))
+	}
+}
+
+// ThreadFollowerIDs returns the ids of the users following a thread, the ones to tell about new replies
+func ThreadFollowerIDs(threadID uuid.UUID) (ids []uuid.UUID, err error) {
+	err = server.DB.Model(&ThreadSubscription{}).Where("thread_id = ? AND following = ?", threadID, true).
+		Pluck("user_id", &ids).Error
+	if err != nil {
+		slog.Error("unable to load thread followers", slog.String("threadID", threadID.String()), slog.Any("err", err))
+	}
+	return
+}
+
+// threadFor loads the root message of the thread in the url, if the user can see it
+func threadFor(w http.ResponseWriter, r *http.Request, user users.User) (root Message, ok bool) {
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		abort(w, r, err)
+		return
+	}
+
+	err = server.DB.Preload("User").Preload("Tags").Preload("Likes").Preload("MessageReactions", liveReactions).Where("id = ?", id).First(&root).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	} else if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	audience, err := root.Audience()
+	if err != nil || !slices.Contains(audience, user.ID) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"status": "error", "err": "not allowed to see this thread"})
+		return
+	}
+	return root, true
+}
+
+// GetThread returns a message with a page of its replies, oldest first. Pass the nextCursor of a page
+// as ?cursor= to get the next one, and ?limit= to change the page size.
+func GetThread(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	root, ok := threadFor(w, r, user)
+	if !ok {
+		return
+	}
+
+	limit := utils.DefaultQuery(r, "limit", threadPageSize)
+	if limit <= 0 || limit > maxThreadPageSize {
+		limit = maxThreadPageSize
+	}
+
+	stmt := server.DB.Preload("User").Preload("Tags").Preload("Likes").Preload("MessageReactions", liveReactions).
+		Where("in_reply_to_id = ?", root.ID).Order("created_at, id").Limit(limit + 1)
+
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var after Message
+		err := server.DB.Select("id", "created_at").Where("id = ? AND in_reply_to_id = ?", cursor, root.ID).First(&after).Error
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, render.M{"status": "error", "err": "invalid cursor"})
+			return
+		}
+		stmt = stmt.Where("(created_at > ? OR (created_at = ? AND id > ?))", after.CreatedAt, after.CreatedAt, after.ID)
+	}
+
+	replies := []Message{}
+	if err := stmt.Find(&replies).Error; err != nil {
+		slog.Error("unable to load thread", slog.String("threadID", root.ID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	var nextCursor string
+	if len(replies) > limit {
+		replies = replies[:limit]
+		nextCursor = replies[limit-1].ID.String()
+	}
+
+	var subscription ThreadSubscription
+	server.DB.Where("thread_id = ? AND user_id = ?", root.ID, user.ID).Limit(1).Find(&subscription)
+
+	unread := server.DB.Model(&Message{}).Where("in_reply_to_id = ? AND deleted_at IS NULL AND user_id != ?", root.ID, user.ID)
+	if subscription.ReadAt != nil {
+		unread = unread.Where("created_at > ?", *subscription.ReadAt)
+	}
+	var unreadCount int64
+	unread.Count(&unreadCount)
+
+	render.JSON(w, r, render.M{"message": root, "replies": replies, "nextCursor": nextCursor,
+		"following": subscription.Following, "readAt": subscription.ReadAt, "unread": unreadCount})
+}
+
+// ReadThread marks the replies of a thread as read by the user
+func ReadThread(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	root, ok := threadFor(w, r, user)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	err := server.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "thread_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"read_at", "updated_at"}),
+	}).Create(&ThreadSubscription{ThreadID: root.ID, UserID: user.ID, ReadAt: &now}).Error
+	if err != nil {
+		slog.Error("unable to mark thread read", slog.String("threadID", root.ID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, render.M{"status": "OK"})
+}
+
+// FollowThread follows or unfollows a thread, with a {"follow": true|false} body
+func FollowThread(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	root, ok := threadFor(w, r, user)
+	if !ok {
+		return
+	}
+
+	type param struct {
+		Follow bool `json:"follow" binding:""`
+	}
+	followParam := param{}
+	if err := binding.Bind(r, &followParam); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"status": "fail",
+			"err": err.Error() + " - Check JSON body input is not malformed"})
+		return
+	}
+
+	err := server.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "thread_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"following", "updated_at"}),
+	}).Create(&ThreadSubscription{ThreadID: root.ID, UserID: user.ID, Following: followParam.Follow}).Error
+	if err != nil {
+		slog.Error("unable to follow thread", slog.String("threadID", root.ID.String()), slog.Any("err", err))
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, render.M{"status": "OK", "following": followParam.Follow})
+}
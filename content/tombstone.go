@@ -0,0 +1,105 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var ErrMessageDeleted = errors.New("message has been deleted")
+
+// DeleteMessage turns a message into a tombstone, by its author or a moderator of its channel. The
+// tombstone keeps its place in the channel and thread, but loses its content, tags, revisions and pins,
+// and is dropped from the search index. Deleting a tombstone again returns it unchanged.
+func DeleteMessage(user users.User, id uuid.UUID, reason string) (msg Message, err error) {
+
+	err = server.DB.Where("id = ?", id).First(&msg).Error
+	if err != nil {
+		slog.Error("unable to load message to delete", slog.String("id", id.String()), slog.Any("err", err))
+		return msg, err
+	}
+	if msg.UserID != user.ID && (msg.ChannelID == nil || !IsModerator(user.ID, *msg.ChannelID)) {
+		return msg, ErrNotAuthor
+	}
+	if msg.DeletedAt != nil {
+		return msg, nil
+	}
+	if err = writable(msg.ChannelID); err != nil {
+		return msg, err
+	}
+
+	now := time.Now()
+	msg.DeletedAt, msg.DeletedByID, msg.DeleteReason = &now, &user.ID, reason
+	msg.Title, msg.Message, msg.ExternalURL, msg.Tags = "", "", "", nil
+	if msg.ChannelID != nil {
+		// tombstones are replayed like edits
+		msg.Seq, err = NextSequence(*msg.ChannelID)
+		if err != nil {
+			return msg, err
+		}
+	}
+
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&msg).Select("deleted_at", "deleted_by_id", "delete_reason", "title", "message",
+			"external_url", "seq").Updates(&msg).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Unscoped().Where("message_id = ?", id).Delete(&MessageTag{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("message_id = ?", id).Delete(&ChannelPin{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("message_id = ?", id).Delete(&MessageRevision{}).Error
+	})
+	if err != nil {
+		slog.Error("unable to delete message", slog.String("id", id.String()), slog.Any("err", err))
+		return msg, err
+	}
+
+	if msg.InReplyToID != nil {
+		updateThreadStats(*msg.InReplyToID)
+	}
+	go server.RemoveEntry(id)
+	return msg, nil
+}
+
+// DeletePosting deletes a message, with an optional ?reason=
+func DeletePosting(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusPreconditionFailed)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	msg, err := DeleteMessage(user, id, r.URL.Query().Get("reason"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	} else if errors.Is(err, ErrNotAuthor) || errors.Is(err, ErrChannelArchived) {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	} else if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	emit(Event{Type: "delete", UserID: user.ID, Message: &msg})
+	render.JSON(w, r, msg)
+}
@@ -0,0 +1,157 @@
+package content
+
+import (
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// mentions are written as @ followed by the email of a participant of the channel
+var mentionPattern = regexp.MustCompile(`@([A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,})`)
+
+// MessageMention records that a channel message mentions a participant of the channel
+type MessageMention struct {
+	MessageID uuid.UUID `json:"messageId" gorm:"type:char(36);primaryKey"`
+	UserID    uuid.UUID `json:"userId" gorm:"type:char(36);primaryKey;index"`
+}
+
+// ChannelUnread holds how many messages of a channel a user hasn't read yet, and how many of those mention them
+type ChannelUnread struct {
+	ChannelID uuid.UUID `json:"channelId"`
+	Unread    int       `json:"unread"`
+	Mentions  int       `json:"mentions"`
+}
+
+// UnreadSummary holds the channels of a user with unread messages, and the totals across them
+type UnreadSummary struct {
+	Channels []ChannelUnread `json:"channels"`
+	Unread   int             `json:"unread"`
+	Mentions int             `json:"mentions"`
+}
+
+// recordMentions saves who a channel message mentions, replacing what an earlier version of the message
+// mentioned, and returns their ids. Authors don't mention themselves.
+func recordMentions(msg Message) (ids []uuid.UUID, err error) {
+	if msg.ChannelID == nil {
+		return nil, nil
+	}
+	err = server.DB.Where("message_id = ?", msg.ID).Delete(&MessageMention{}).Error
+	if err != nil {
+		return
+	}
+
+	var emails []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(msg.Message, -1) {
+		emails = append(emails, strings.ToLower(match[1]))
+	}
+	if len(emails) == 0 {
+		return nil, nil
+	}
+
+	err = server.DB.Model(&users.User{}).Where("LOWER(email) IN ? AND id != ? AND id IN (?)", emails, msg.UserID,
+		server.DB.Table("channel_participants").Select("user_id").Where("channel_id = ? AND approved = ?", *msg.ChannelID, true)).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	mentions := make([]MessageMention, len(ids))
+	for i, id := range ids {
+		mentions[i] = MessageMention{MessageID: msg.ID, UserID: id}
+	}
+	err = server.DB.Create(&mentions).Error
+	return
+}
+
+// UnreadCounts counts, per channel, the messages posted by others after the read watermark of the user,
+// leaving out replies, which are followed in their threads, and system messages. Mentions of the user
+// count replies too. Channels without anything unread are left out.
+func UnreadCounts(userID uuid.UUID, channelIDs []uuid.UUID) (counts map[uuid.UUID]ChannelUnread, err error) {
+	counts = map[uuid.UUID]ChannelUnread{}
+	if len(channelIDs) == 0 {
+		return
+	}
+
+	type row struct {
+		ChannelID uuid.UUID
+		Count     int
+	}
+	var unread, mentioned []row
+	err = server.DB.Table("messages m").Select("m.channel_id AS channel_id, COUNT(*) AS count").
+		Joins("LEFT JOIN reads r ON r.channel_id = m.channel_id AND r.user_id = ?", userID).
+		Where("m.channel_id IN ? AND m.deleted_at IS NULL AND m.user_id != ? AND m.in_reply_to_id IS NULL AND m.message_type != ?",
+			channelIDs, userID, "system").
+		Where("r.read_at IS NULL OR m.created_at > r.read_at").
+		Group("m.channel_id").Scan(&unread).Error
+	if err == nil {
+		err = server.DB.Table("message_mentions mm").Select("m.channel_id AS channel_id, COUNT(*) AS count").
+			Joins("JOIN messages m ON m.id = mm.message_id").
+			Joins("LEFT JOIN reads r ON r.channel_id = m.channel_id AND r.user_id = ?", userID).
+			Where("mm.user_id = ? AND m.channel_id IN ? AND m.deleted_at IS NULL", userID, channelIDs).
+			Where("r.read_at IS NULL OR m.created_at > r.read_at").
+			Group("m.channel_id").Scan(&mentioned).Error
+	}
+	if err != nil {
+		slog.Error("unable to count unread messages", slog.String("userID", userID.String()), slog.Any("err", err))
+		return
+	}
+
+	for _, u := range unread {
+		counts[u.ChannelID] = ChannelUnread{ChannelID: u.ChannelID, Unread: u.Count}
+	}
+	for _, m := range mentioned {
+		count := counts[m.ChannelID]
+		count.ChannelID, count.Mentions = m.ChannelID, m.Count
+		counts[m.ChannelID] = count
+	}
+	return
+}
+
+// UserUnread sums up the unread messages and mentions in the channels a user takes part in, archived
+// channels left out
+func UserUnread(userID uuid.UUID) (summary UnreadSummary, err error) {
+	summary.Channels = []ChannelUnread{}
+
+	var channelIDs []uuid.UUID
+	err = server.DB.Table("channel_participants p").Joins("JOIN channels c ON c.id = p.channel_id").
+		Where("p.user_id = ? AND p.approved = ? AND c.archived_at IS NULL AND c.deleted_at IS NULL", userID, true).
+		Pluck("p.channel_id", &channelIDs).Error
+	if err != nil {
+		slog.Error("unable to load channels of user", slog.String("userID", userID.String()), slog.Any("err", err))
+		return
+	}
+
+	counts, err := UnreadCounts(userID, channelIDs)
+	if err != nil {
+		return
+	}
+	for _, id := range channelIDs {
+		count, ok := counts[id]
+		if !ok {
+			continue
+		}
+		summary.Channels = append(summary.Channels, count)
+		summary.Unread += count.Unread
+		summary.Mentions += count.Mentions
+	}
+	return
+}
+
+// GetUnread returns the unread summary of the user, for clients to show badges without loading channels
+func GetUnread(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	summary, err := UserUnread(user.ID)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, summary)
+}
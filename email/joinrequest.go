@@ -0,0 +1,39 @@
+package email
+
+import (
+	"areo/go-chat-backend/users"
+	"bytes"
+	"html/template"
+	"log/slog"
+	"os"
+)
+
+// SendJoinRequestEmail tells a moderator of a closed channel that someone asked to join it
+func SendJoinRequestEmail(moderator users.User, applicant users.User, channelID, channelTitle string) error {
+
+	t, err := template.New("emailtemplates/joinrequest.html").ParseFiles("emailtemplates/joinrequest.html")
+	if err != nil {
+		slog.Error("unable to parse email template", slog.Any("err", err))
+		return err
+	}
+
+	serverHost := os.Getenv("SERVER_HOST")
+
+	if serverHost == "" {
+		serverHost = "http://localhost:8080"
+	}
+
+	data := map[string]interface{}{
+		"Channel":   channelTitle,
+		"URL":       template.URL(serverHost + "/#/channels/" + channelID + "/requests"),
+		"applicant": applicant,
+	}
+
+	var tpl bytes.Buffer
+	if err := t.ExecuteTemplate(&tpl, "joinrequest.html", data); err != nil {
+		slog.Error("unable to execute email template", slog.Any("err", err))
+		return err
+	}
+	slog.Debug("email", slog.String("content", string(tpl.Bytes())))
+	return SendEmail2(moderator.Email, "Request to join "+channelTitle, string(tpl.Bytes()), false)
+}
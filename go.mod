@@ -6,6 +6,7 @@ toolchain go1.23.5
 
 require (
 	github.com/SherClockHolmes/webpush-go v1.2.0
+	github.com/alicebob/miniredis/v2 v2.37.0
 	github.com/anuragkumar19/binding v0.1.4
 	github.com/badoux/goscraper v0.0.0-20190827161153-36995ce6b19f
 	github.com/blevesearch/bleve/v2 v2.3.4
@@ -20,6 +21,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.14
 	github.com/onrik/gorm-logrus v0.4.0
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c
+	github.com/redis/go-redis/v9 v9.7.3
 	github.com/relvacode/iso8601 v1.1.0
 	github.com/samber/slog-chi v1.13.0
 	github.com/stretchr/testify v1.10.0
@@ -49,7 +51,9 @@ require (
 	github.com/blevesearch/zapx/v13 v13.3.5 // indirect
 	github.com/blevesearch/zapx/v14 v14.3.5 // indirect
 	github.com/blevesearch/zapx/v15 v15.3.5 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/go-sql-driver/mysql v1.6.0 // indirect
 	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
 	github.com/golang/geo v0.0.0-20210211234256-740aa86cb551 // indirect
@@ -65,6 +69,7 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rogpeppe/go-internal v1.8.0 // indirect
 	github.com/sirupsen/logrus v1.9.2 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	go.etcd.io/bbolt v1.3.5 // indirect
 	go.opentelemetry.io/otel v1.29.0 // indirect
 	go.opentelemetry.io/otel/trace v1.29.0 // indirect
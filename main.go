@@ -102,6 +102,7 @@ func main() {
 	users.InitSchema()
 	content.InitSchema()
 	media.InitSchema()
+	messaging.InitSchema()
 
 	email.InitEmail()
 
@@ -180,6 +181,11 @@ func setupAPIRoutes(router *chi.Mux) {
 
 		api.Post("/register", account.Register)
 		api.Post("/resetpassword", account.ResetPassword)
+
+		// event streams authenticate like the web socket, taking the token from the query as well
+		api.Get("/events", messaging.Events)
+		api.Get("/events/poll", messaging.PollEvents)
+		api.Get("/protocol/schema", messaging.GetProtocolSchema)
 		//api.Post("/verify-registration", signup.VerifyRegistration) // not currently used, we use an oauth2 endpoint instead
 
 		api.Group(func(authorized chi.Router) {
@@ -193,6 +199,8 @@ func setupAPIRoutes(router *chi.Mux) {
 			authorized.Post("/media", media.PostMediaHandle)
 
 			authorized.Get("/users", users.GetUsers)
+			authorized.Get("/users/presence", messaging.GetPresence)
+			authorized.Get("/calls/ice", messaging.GetICEServers)
 			authorized.Get("/users/{id}", users.GetUser)
 			authorized.Post("/users/{id}", users.PostUser)
 
@@ -205,10 +213,13 @@ func setupAPIRoutes(router *chi.Mux) {
 
 			authorized.Post("/user/keyword", users.SaveKeyword)
 			authorized.Get("/user/keywords", users.GetKeywords)
+			authorized.Get("/user/saved", content.GetSavedMessages)
 
 			authorized.Get("/user/byemail/{email}", users.GetUserByEmail)
 			//authorized.Get("/users", users.ActiveUsers)
 
+			authorized.Get("/unread", content.GetUnread)
+
 			authorized.Get("/channels", content.GetChannels)
 			authorized.Get("/channels/{id}", content.GetChannel)
 			authorized.Get("/channels/{id}/messages", content.GetChannelMessages)
@@ -220,6 +231,7 @@ func setupAPIRoutes(router *chi.Mux) {
 			authorized.Post("/admin/reindex", content.Reindex)
 			authorized.Get("/admin/search", content.Search)
 			authorized.Post("/admin/stats", content.Stats)
+			authorized.Delete("/admin/channels/{id}", content.PurgeChannelPosting)
 
 			authorized.Get("/messages/{id}", content.GetPrivateMessages) // might need to change this url
 			authorized.Get("/message/{id}", content.GetMessage)
@@ -228,19 +240,40 @@ func setupAPIRoutes(router *chi.Mux) {
 
 			authorized.Get("/chats", content.GetChats2)
 
-			authorized.Post("/channels/{id}/subscribe", content.SubscribeToChannel)
+			authorized.With(messaging.RateLimit("channel")).Post("/channels/{id}/subscribe", content.SubscribeToChannel)
 			authorized.Get("/channels/subscriptions", content.GetSubscriptions)
 			authorized.Get("/channels/suggestions", content.GetSuggestions)
-			authorized.Post("/channels/{id}", content.SaveChannel)
+			authorized.With(messaging.RateLimit("channel")).Post("/channels/{id}", content.SaveChannel)
 			authorized.Post("/channels/{id}/read", content.ReadChannel)
 			authorized.Delete("/channels/{id}", content.DeleteChannel)
-
-			authorized.Post("/messages/{id}/read", content.ReadPosting)
-			authorized.Post("/messages/{id}/like", content.LikePosting)
+			authorized.Post("/channels/{id}/archive", content.ArchiveChannelPosting)
+			authorized.Get("/channels/{id}/members", content.GetMembers)
+			authorized.Get("/channels/{id}/requests", content.GetJoinRequests)
+			authorized.Get("/channels/{id}/invites", content.GetInvites)
+			authorized.Post("/channels/{id}/invites", content.CreateInvite)
+			authorized.Delete("/channels/{id}/invites/{inviteId}", content.RevokeInvite)
+			authorized.With(messaging.RateLimit("channel")).Post("/invites/{code}", content.RedeemInvitePosting)
+			authorized.Post("/channels/{id}/requests/{userId}", content.AnswerJoinRequestPosting)
+			authorized.Post("/channels/{id}/members/{userId}", content.SetMemberRole)
+			authorized.Get("/channels/{id}/pins", content.GetPins)
+			authorized.Post("/channels/{id}/pins", content.PinPosting)
+			authorized.Delete("/channels/{id}/pins/{pinId}", content.UnpinPosting)
+
+			authorized.With(messaging.RateLimit("read")).Post("/messages/{id}/read", content.ReadPosting)
+			authorized.With(messaging.RateLimit("react")).Post("/messages/{id}/like", content.LikePosting)
+			authorized.With(messaging.RateLimit("react")).Post("/messages/{id}/reactions", content.AddReaction)
+			authorized.With(messaging.RateLimit("react")).Delete("/messages/{id}/reactions/{emoji}", content.RemoveReaction)
+			authorized.Get("/messages/{id}/revisions", content.GetMessageRevisions)
+			authorized.Post("/messages/{id}/save", content.SavePosting)
+			authorized.Delete("/messages/{id}/save", content.UnsavePosting)
+			authorized.Delete("/messages/{id}", content.DeletePosting)
+			authorized.Get("/messages/{id}/thread", content.GetThread)
+			authorized.With(messaging.RateLimit("read")).Post("/messages/{id}/thread/read", content.ReadThread)
+			authorized.Post("/messages/{id}/thread/follow", content.FollowThread)
 
 			authorized.Get("/posts", content.GetPosts)
 			authorized.Get("/posts/{id}", content.GetPost)
-			authorized.Post("/posts/{id}", content.SavePost)
+			authorized.With(messaging.RateLimit("post")).Post("/posts/{id}", content.SavePost)
 
 			authorized.Post("/preview", utils.GetUrlData)
 
@@ -257,7 +290,7 @@ func setupAPIRoutes(router *chi.Mux) {
 
 	registerAuth(router)
 
-	messaging.Configure(router)
+	messaging.Configure(router, oauthSecret)
 }
 
 func registerAuth(router *chi.Mux) {
@@ -4,6 +4,7 @@ import (
 	"areo/go-chat-backend/account"
 	"areo/go-chat-backend/content"
 	"areo/go-chat-backend/media"
+	"areo/go-chat-backend/messaging"
 	"areo/go-chat-backend/users"
 	"bytes"
 	"encoding/json"
@@ -18,6 +19,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -117,6 +119,9 @@ func OAUTHverify(registrationToken string) (oauthToken string, err error) {
 	return fmt.Sprintf("Bearer %s", respJSON.AccessToken), err
 }
 
+// join request emails sent during the tests, by moderator email and channel id
+var joinRequestEmails sync.Map
+
 func TestMain(m *testing.M) {
 
 	oauthSecret = os.Getenv("OAUTH_SECRET")
@@ -129,11 +134,21 @@ func TestMain(m *testing.M) {
 	users.InitSchema()
 	content.InitSchema()
 	media.InitSchema()
+	messaging.InitSchema()
 
 	router = chi.NewMux()
 
 	setupAPIRoutes(router)
 
+	// the tests share their users, so REST calls add up across tests far beyond what a user would do
+	messaging.SetLimiter(messaging.NewLimiter("", "*=100/1000,channel=100/1000,post=100/1000"))
+
+	// keep join request emails to ourselves
+	content.SendJoinRequestEmail = func(moderator users.User, applicant users.User, channelID, channelTitle string) error {
+		joinRequestEmails.Store(moderator.Email+" "+channelID, applicant.Email)
+		return nil
+	}
+
 	code := m.Run()
 
 	// should clear out unit-test.sqlite before exiting
@@ -0,0 +1,104 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/users"
+	"errors"
+	"github.com/go-chi/oauth"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// how long a socket may stay open without sending an auth frame
+const authTimeout = 10 * time.Second
+
+var (
+	tokenProvider *oauth.TokenProvider
+
+	ErrNotAuthenticated = errors.New("not authenticated")
+	ErrInvalidToken     = errors.New("invalid token")
+	ErrTokenExpired     = errors.New("token expired")
+	ErrUnknownUser      = errors.New("token belongs to a user that no longer exists")
+)
+
+func configureAuth(secret string) {
+	// same formatter oauth.Authorize falls back to when passed nil
+	tokenProvider = oauth.NewTokenProvider(oauth.NewSHA256RC4TokenSecurityProvider([]byte(secret)))
+}
+
+// Authenticate validates a bearer token the same way the oauth.Authorize middleware does,
+// and loads the user the token was issued to. The "Bearer " prefix is optional.
+func Authenticate(token string) (user users.User, err error) {
+
+	token = strings.TrimSpace(token)
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	if token == "" {
+		return user, ErrNotAuthenticated
+	}
+
+	t, err := tokenProvider.DecryptToken(token)
+	if err != nil {
+		return user, ErrInvalidToken
+	}
+	if time.Now().UTC().After(t.CreationDate.Add(t.ExpiresIn)) {
+		return user, ErrTokenExpired
+	}
+
+	user, err = users.Load(t.Credential)
+	if err == nil && user.ID == uuid.Nil {
+		return user, ErrUnknownUser
+	}
+	return
+}
+
+// requestToken looks for a bearer token in the handshake request. Browsers can't set headers
+// on web socket requests, so we also accept the token as a query parameter.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return auth
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// awaitAuthFrame waits for the first frame on an upgraded socket, which must be an auth frame
+// carrying a valid bearer token.
+func awaitAuthFrame(ws *websocket.Conn) (user users.User, err error) {
+
+	err = ws.SetReadDeadline(time.Now().Add(authTimeout))
+	if err != nil {
+		return user, err
+	}
+
+	var proto Protocol
+	if err = ws.ReadJSON(&proto); err != nil {
+		return user, err
+	}
+	if proto.Type != "auth" {
+		slog.Warn("expected auth frame", slog.String("type", proto.Type))
+		return user, ErrNotAuthenticated
+	}
+
+	user, err = Authenticate(proto.Token)
+	if err != nil {
+		return user, err
+	}
+
+	// clear the deadline again, the read loop takes over from here
+	return user, ws.SetReadDeadline(time.Time{})
+}
+
+// closeUnauthenticated tells the client why we hang up before closing the socket
+func closeUnauthenticated(ws *websocket.Conn, err error) {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+	if err := ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		slog.Debug("unable to send close frame", slog.Any("err", err))
+	}
+}
@@ -0,0 +1,90 @@
+package messaging
+
+import (
+	"github.com/gofrs/uuid"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Envelope is what travels over the broker; a frame together with the users it is meant for
+type Envelope struct {
+	Frame    Protocol    `json:"frame"`
+	Audience []uuid.UUID `json:"audience"`
+}
+
+// Broker passes frames between backend instances. Every instance subscribes, and delivers what it
+// receives to its own sockets, so a frame published on one node reaches users on all nodes.
+type Broker interface {
+	Publish(env Envelope) error
+	Subscribe(handler func(Envelope)) error
+	Close() error
+}
+
+var broker Broker = NewLocalBroker()
+
+// newBroker picks a broker based on the environment; redis if REDIS_URL is set, otherwise
+// in-process for a single instance
+func newBroker() Broker {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		slog.Info("using in-process message broker")
+		return NewLocalBroker()
+	}
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		slog.Error("unable to parse REDIS_URL, falling back to in-process message broker", slog.Any("err", err))
+		return NewLocalBroker()
+	}
+
+	channel := os.Getenv("REDIS_CHANNEL")
+	if channel == "" {
+		channel = "go-chat-backend:frames"
+	}
+	slog.Info("using redis message broker", slog.String("addr", opts.Addr), slog.String("channel", channel))
+	return NewRedisBroker(redis.NewClient(opts), channel)
+}
+
+// publish hands a frame and its audience to the broker
+func publish(proto Protocol, audience []uuid.UUID) {
+	proto.V = ProtocolVersion
+	err := broker.Publish(Envelope{Frame: proto, Audience: audience})
+	if err != nil {
+		slog.Error("unable to publish frame", slog.String("type", proto.Type), slog.Any("err", err))
+	}
+}
+
+// LocalBroker delivers frames within the process, for running a single instance
+type LocalBroker struct {
+	mu       sync.RWMutex
+	handlers []func(Envelope)
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+func (b *LocalBroker) Publish(env Envelope) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(env)
+	}
+	return nil
+}
+
+func (b *LocalBroker) Subscribe(handler func(Envelope)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *LocalBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = nil
+	return nil
+}
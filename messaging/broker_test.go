@@ -0,0 +1,58 @@
+package messaging
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofrs/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// receive waits for the next envelope a subscription hands over
+func receive(t *testing.T, received chan Envelope) Envelope {
+	select {
+	case env := <-received:
+		return env
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for envelope")
+	}
+	return Envelope{}
+}
+
+func TestLocalBroker(t *testing.T) {
+	b := NewLocalBroker()
+	received := make(chan Envelope, 1)
+	assert.NoError(t, b.Subscribe(func(env Envelope) { received <- env }))
+
+	userID, _ := uuid.NewV4()
+	assert.NoError(t, b.Publish(Envelope{Frame: Protocol{Type: "msg"}, Audience: []uuid.UUID{userID}}))
+
+	env := receive(t, received)
+	assert.Equal(t, "msg", env.Frame.Type)
+	assert.Equal(t, []uuid.UUID{userID}, env.Audience)
+}
+
+// two brokers sharing a redis server behave like two backend instances
+func TestRedisBroker(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	node1 := NewRedisBroker(redis.NewClient(&redis.Options{Addr: s.Addr()}), "test:frames")
+	node2 := NewRedisBroker(redis.NewClient(&redis.Options{Addr: s.Addr()}), "test:frames")
+	defer node1.Close()
+	defer node2.Close()
+
+	received1 := make(chan Envelope, 1)
+	received2 := make(chan Envelope, 1)
+	assert.NoError(t, node1.Subscribe(func(env Envelope) { received1 <- env }))
+	assert.NoError(t, node2.Subscribe(func(env Envelope) { received2 <- env }))
+
+	userID, _ := uuid.NewV4()
+	assert.NoError(t, node1.Publish(Envelope{Frame: Protocol{Type: "typ", ID: "1"}, Audience: []uuid.UUID{userID}}))
+
+	for _, received := range []chan Envelope{received1, received2} {
+		env := receive(t, received)
+		assert.Equal(t, "typ", env.Frame.Type)
+		assert.Equal(t, []uuid.UUID{userID}, env.Audience)
+	}
+}
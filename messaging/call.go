@@ -0,0 +1,225 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	"areo/go-chat-backend/server"
+	"errors"
+	"github.com/gofrs/uuid"
+	"log/slog"
+	"time"
+)
+
+const (
+	CallRinging  = "ringing"
+	CallAccepted = "accepted"
+	CallRejected = "rejected"
+	CallEnded    = "ended"
+	CallMissed   = "missed"
+
+	// calls not answered within this time are missed
+	ringTimeout = 45 * time.Second
+)
+
+var ErrCallState = errors.New("call can't make this transition")
+
+// CallSession is the state of a call between two users. It lives in the database, as caller and
+// callee may well be connected to different instances.
+type CallSession struct {
+	ID         uuid.UUID `gorm:"type:char(36);primaryKey"`
+	CallerID   uuid.UUID `gorm:"type:char(36);index"`
+	CalleeID   uuid.UUID `gorm:"type:char(36);index"`
+	State      string    `gorm:"type:char(16);index"`
+	StartedAt  time.Time
+	AcceptedAt *time.Time
+	EndedAt    *time.Time
+}
+
+// peer returns the other party of the call, if the user is a party at all
+func (s CallSession) peer(userID uuid.UUID) (uuid.UUID, bool) {
+	switch userID {
+	case s.CallerID:
+		return s.CalleeID, true
+	case s.CalleeID:
+		return s.CallerID, true
+	}
+	return uuid.Nil, false
+}
+
+// signal handles call signaling frames. Offers, answers and candidates only ever go to the other party
+// of the call, while changes of the call state go to all sockets of both parties.
+func signal(client *Client, proto Protocol, call *Call) {
+	call.UserID = client.user.ID
+
+	if proto.ChannelID != nil {
+		// signaling between participants of a huddle
+		relayHuddle(client, proto, call)
+		return
+	}
+	if proto.Type == "call" {
+		startCall(client, proto, call)
+		return
+	}
+
+	var session CallSession
+	err := server.DB.Where("id = ?", call.ID).First(&session).Error
+	if err != nil {
+		slog.Warn("ignoring frame for unknown call", slog.String("callID", call.ID.String()), slog.Any("err", err))
+		fail(client, proto, invalidField("call.id", "no such call"))
+		return
+	}
+	peerID, ok := session.peer(client.user.ID)
+	if !ok {
+		slog.Warn("ignoring frame for call of other users", slog.String("callID", session.ID.String()),
+			slog.String("userID", client.user.ID.String()))
+		fail(client, proto, &ProtocolError{Code: ErrCodeNotAllowed, Message: "only the parties of a call signal it"})
+		return
+	}
+
+	switch proto.Type {
+	case "candidate":
+		ok = session.State == CallRinging || session.State == CallAccepted
+		if ok {
+			forward(proto, peerID)
+		}
+	case "answer":
+		ok = client.user.ID == session.CalleeID && advance(&session, CallRinging, CallAccepted)
+		if ok {
+			forward(proto, peerID)
+			announceCall(session)
+		}
+	case "reject":
+		ok = client.user.ID == session.CalleeID && advance(&session, CallRinging, CallRejected)
+		if ok {
+			finishCall(session)
+		}
+	case "hangup":
+		ok = hangup(session, client.user.ID)
+	}
+	if !ok {
+		fail(client, proto, &ProtocolError{Code: ErrCodeNotAllowed, Message: ErrCallState.Error()})
+	}
+}
+
+// startCall sets up a call and rings the recipient
+func startCall(client *Client, proto Protocol, call *Call) {
+	calleeID, err := uuid.FromString(call.RecipientID)
+	if err != nil || calleeID == client.user.ID {
+		slog.Warn("ignoring call without valid recipient", slog.String("userID", client.user.ID.String()))
+		fail(client, proto, invalidField("call.recipientID", "calls need the id of another user"))
+		return
+	}
+	if call.ID == uuid.Nil {
+		call.ID, _ = uuid.NewV4()
+	}
+
+	session := CallSession{ID: call.ID, CallerID: client.user.ID, CalleeID: calleeID, State: CallRinging, StartedAt: time.Now()}
+	err = server.DB.Create(&session).Error
+	if err != nil {
+		slog.Error("unable to start call", slog.String("callID", session.ID.String()), slog.Any("err", err))
+		fail(client, proto, &ProtocolError{Code: ErrCodeInternal, Message: "unable to start call"})
+		return
+	}
+
+	time.AfterFunc(ringTimeout, func() {
+		if advance(&session, CallRinging, CallMissed) {
+			finishCall(session)
+		}
+	})
+
+	call.State = CallRinging
+	forward(proto, calleeID)
+	announceCall(session)
+}
+
+// hangup ends a call, returning false when it was over already. Hanging up before the call was answered
+// makes it missed when done by the caller, and rejected when done by the callee.
+func hangup(session CallSession, userID uuid.UUID) bool {
+	from, to := CallAccepted, CallEnded
+	if session.State == CallRinging {
+		from, to = CallRinging, CallMissed
+		if userID == session.CalleeID {
+			to = CallRejected
+		}
+	}
+	if !advance(&session, from, to) {
+		return false
+	}
+	finishCall(session)
+	return true
+}
+
+// advance moves a call from one state to the next. The update is conditional on the current state, so
+// only one of several racing transitions wins.
+func advance(session *CallSession, from string, to string) bool {
+	now := time.Now()
+	updates := map[string]interface{}{"state": to}
+	if to == CallAccepted {
+		updates["accepted_at"] = now
+	} else {
+		updates["ended_at"] = now
+	}
+
+	res := server.DB.Model(&CallSession{}).Where("id = ? AND state = ?", session.ID, from).Updates(updates)
+	if res.Error != nil {
+		slog.Error("unable to update call", slog.String("callID", session.ID.String()), slog.Any("err", res.Error))
+		return false
+	}
+	if res.RowsAffected == 0 {
+		slog.Debug("ignoring call transition", slog.String("callID", session.ID.String()), slog.Any("err", ErrCallState),
+			slog.String("from", from), slog.String("to", to))
+		return false
+	}
+
+	session.State = to
+	if to == CallAccepted {
+		session.AcceptedAt = &now
+	} else {
+		session.EndedAt = &now
+	}
+	return true
+}
+
+// forward passes a signaling frame on to the other party of a call
+func forward(proto Protocol, peerID uuid.UUID) {
+	proto.Call.RecipientID = peerID.String()
+	publish(proto, []uuid.UUID{peerID})
+}
+
+// announceCall tells both parties about the state of a call, so e.g. other devices of the callee stop ringing
+func announceCall(session CallSession) {
+	publish(Protocol{Type: "callstate", Call: &Call{ID: session.ID, UserID: session.CallerID,
+		RecipientID: session.CalleeID.String(), State: session.State}}, []uuid.UUID{session.CallerID, session.CalleeID})
+}
+
+// finishCall announces the final state of a call and records it in the direct conversation of the parties
+func finishCall(session CallSession) {
+	announceCall(session)
+
+	msg := content.Message{UserID: session.CallerID, RecipientID: &session.CalleeID, MessageType: "system",
+		SystemFlags: "call_" + session.State}
+	if session.AcceptedAt != nil && session.EndedAt != nil {
+		// the call history entry of a call that took place carries its duration
+		msg.Message = session.EndedAt.Sub(*session.AcceptedAt).Round(time.Second).String()
+	}
+
+	msg, err := content.SaveSystemMessage(msg)
+	if err != nil {
+		slog.Error("unable to record call history", slog.String("callID", session.ID.String()), slog.Any("err", err))
+		return
+	}
+	publish(Protocol{Type: "msg", ID: msg.ID.String(), Message: &msg}, []uuid.UUID{session.CallerID, session.CalleeID})
+}
+
+// callsDisconnected hangs up the calls of a user whose last socket has gone
+func callsDisconnected(userID uuid.UUID) {
+	var sessions []CallSession
+	err := server.DB.Where("(caller_id = ? OR callee_id = ?) AND state IN ?", userID, userID,
+		[]string{CallRinging, CallAccepted}).Find(&sessions).Error
+	if err != nil {
+		slog.Error("unable to load calls of user", slog.String("userID", userID.String()), slog.Any("err", err))
+		return
+	}
+	for _, session := range sessions {
+		hangup(session, userID)
+	}
+}
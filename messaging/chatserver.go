@@ -2,45 +2,67 @@ package messaging
 
 import (
 	"areo/go-chat-backend/content"
+	"areo/go-chat-backend/users"
 	"github.com/go-chi/chi/v5"
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/websocket"
 	"log/slog"
 	"net/http"
+	"os"
+	"time"
 )
 
-var clients = make(map[*websocket.Conn]bool) // connected clients
-var broadcast = make(chan Protocol)          // broadcast channel
-
 var upgrader = websocket.Upgrader{
-	// we can whitelist signed in users by looking at their ip address as signin time
-	// need to complete auth proto on websocket
+	// authentication is done using the bearer token, either during the handshake or in the first frame
 	CheckOrigin: func(r *http.Request) bool {
 		slog.Debug("checking origin", slog.String("host", r.Host), slog.String("referer", r.Referer()))
 		return true
 	},
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    subprotocols,
 }
 
-func Configure(router *chi.Mux) {
+func Configure(router *chi.Mux, oauthSecret string) {
+	configureAuth(oauthSecret)
+	SetLimiter(NewLimiter(os.Getenv("RATE_LIMITS"), os.Getenv("RATE_LIMITS_USER")))
+
+	// frames are published to the broker, and whatever the broker hands back is delivered to our own sockets
+	broker = newBroker()
+	err := broker.Subscribe(func(env Envelope) {
+		hub.send(newOutbound(env.Frame, env.Audience))
+	})
+	if err != nil {
+		slog.Error("unable to subscribe to message broker", slog.Any("err", err))
+	}
+
+	// what is done through the REST API reaches connected clients as well
+	content.OnEvent(relayEvent)
+
 	router.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
 		handleConnections(w, r)
 	})
 
-	go handleMessages()
+	go hub.run()
+	go presence.run()
+	go polls.expire()
+	go remind()
 }
 
 type Typing struct {
-	Email  string    `json:"email"`
-	UserID uuid.UUID `json:"userId"`
-	ID     uuid.UUID `json:"id"`
+	Email     string     `json:"email"`
+	UserID    uuid.UUID  `json:"userId"`
+	ID        uuid.UUID  `json:"id"`
+	Stop      bool       `json:"stop,omitempty"`      // the user stopped typing, or the indicator expired
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // when the indicator expires unless refreshed
 }
 
 type Like struct {
 	Email     string    `json:"email"`
 	UserID    uuid.UUID `json:"userId"`
 	MessageID uuid.UUID `json:"id"`
+	Emoji     string    `json:"emoji,omitempty"`  // the default reaction when left out
+	Remove    bool      `json:"remove,omitempty"` // the reaction is taken back
 }
 
 type Read struct {
@@ -53,103 +75,176 @@ type Call struct {
 	RecipientID string    `json:"recipientID"`
 	UserID      uuid.UUID `json:"userId"`
 	ID          uuid.UUID `json:"id"`
-	Connection  string    `json:"connection"`
+	Connection  string    `json:"connection"`      // SDP offer or answer, or ICE candidate
+	State       string    `json:"state,omitempty"` // ringing, accepted, rejected, ended or missed
 }
 
 type Protocol struct {
-	Token   string           `json:"token"` // our bearer token
-	Type    string           `json:"type"`
-	ID      string           `json:"id"`
-	Message *content.Message `json:"message"`
-	Typ     *Typing          `json:"typing"`
-	Call    *Call            `json:"call"`
-	Like    *Like            `json:"like"`
-	Read    *Read            `json:"read"`
+	V         int                         `json:"v,omitempty"` // protocol version, set on frames sent by the server
+	Token     string                      `json:"token"`       // our bearer token
+	Type      string                      `json:"type"`
+	ID        string                      `json:"id"`
+	Ref       string                      `json:"ref,omitempty"` // correlation id chosen by the client, echoed on errors
+	Error     *ProtocolError              `json:"error,omitempty"`
+	ChannelID *uuid.UUID                  `json:"channelId,omitempty"` // channel stream the frame belongs to
+	Seq       uint64                      `json:"seq,omitempty"`       // position in the channel stream
+	Resume    map[uuid.UUID]uint64        `json:"resume,omitempty"`    // last seen sequence number per channel
+	Message   *content.Message            `json:"message"`
+	Typ       *Typing                     `json:"typing"`
+	Call      *Call                       `json:"call"`
+	Like      *Like                       `json:"like"`
+	Read      *Read                       `json:"read"`
+	Presence  *Presence                   `json:"presence,omitempty"`
+	Huddle    *Huddle                     `json:"huddle,omitempty"`
+	Pin       *content.ChannelPin         `json:"pin,omitempty"`
+	Member    *content.ChannelParticipant `json:"member,omitempty"`
+	Unread    *content.UnreadSummary      `json:"unread,omitempty"`
 }
 
 func handleConnections(w http.ResponseWriter, r *http.Request) {
 
-	upgrader.CheckOrigin = CheckAuth
+	// if the handshake carries a token it must be valid, otherwise we expect an auth frame
+	var user users.User
+	var err error
+	token := requestToken(r)
+	if token != "" {
+		user, err = Authenticate(token)
+		if err != nil {
+			slog.Warn("rejecting web socket handshake", slog.Any("err", err))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if !negotiate(r) {
+		slog.Warn("rejecting web socket handshake", slog.Any("subprotocols", websocket.Subprotocols(r)))
+		http.Error(w, "unsupported protocol version", http.StatusBadRequest)
+		return
+	}
 
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Error("unable to upgrade request to web socket", slog.Any("err", err))
+		return
 	}
 	defer ws.Close()
 
-	// Register our new client
-	// have seen concurrent map writes here, TODO: should synchronize access
-
-	// fatal error: concurrent map writes
-	//
-	// goroutine 1302 [running]:
-	// runtime.throw({0x102fd95bf?, 0x0?})
-	// /usr/local/go/src/runtime/panic.go:992 +0x50 fp=0x1400044ea90 sp=0x1400044ea60 pc=0x10276e980
-	// runtime.mapassign_fast64ptr(0x1039354a0?, 0x12acb2180?, 0x1400052a420)
-	// /usr/local/go/src/runtime/map_fast64.go:192 +0x310 fp=0x1400044ead0 sp=0x1400044ea90 pc=0x10274c640
-	// areo/go-chat-backend/messaging.handleConnections({0x12acb2180?, 0x140000ba100?}, 0x14000169290?)
-	// /Users/thor/go/src/areo/go-chat-backend/messaging/chatserver.go:61 +0x128 fp=0x1400044f450 sp=0x1400044ead0 pc=0x102d4d598
-
-	clients[ws] = true
-
-	for {
-		var proto Protocol
-		// Read in a new message as JSON and map it to a Message object
-		err := ws.ReadJSON(&proto)
+	if token == "" {
+		user, err = awaitAuthFrame(ws)
 		if err != nil {
-			slog.Error("unable to read message", slog.Any("err", err))
-			//delete(clients, ws) // we don't currently disconnect..
-			break
-		}
-		slog.Debug("chat", slog.Any("throb", proto.Typ), slog.Any("payload", proto.Message))
-
-		if proto.Type == "auth" && proto.Message != nil {
-			slog.Debug("received auth msg", slog.Any("payload", proto.Message))
-			// TODO
-		} else if proto.Type == "msg" && proto.Message != nil {
-			// persist message
-			*proto.Message, err = content.SaveMessage(*proto.Message) // use returned msg to get message id
-			if err != nil {
-				slog.Error("unable to save message", slog.Any("error", err))
-			}
-		} else if proto.Type == "typ" {
-		} else if proto.Type == "react" {
-			content.LikePost(proto.Like.MessageID, proto.Like.UserID)
-		} else if proto.Type == "read" {
-		} else if proto.Type == "call" {
-			slog.Debug("got call", slog.String("userID", proto.Call.UserID.String()),
-				slog.String("recipientID", proto.Call.RecipientID), slog.String("conn", proto.Call.Connection))
-		} else if proto.Type == "answer" {
-		} else if proto.Type == "candidate" {
+			slog.Warn("closing unauthenticated web socket", slog.Any("err", err))
+			closeUnauthenticated(ws, err)
+			return
 		}
+	}
 
-		broadcast <- proto
+	// confirm authentication, letting the client know which user the socket is bound to
+	err = ws.WriteJSON(Protocol{V: ProtocolVersion, Type: "auth", ID: user.ID.String()})
+	if err != nil {
+		slog.Error("unable to confirm authentication", slog.Any("err", err))
+		return
 	}
+
+	client := newClient(hub, ws, user)
+	hub.register <- client
+	presence.connected(client)
+
+	go client.writePump()
+	client.readPump()
 }
 
-func handleMessages() {
-	for {
-		// Grab the next message from the broadcast channel
-		proto := <-broadcast
+// dispatch handles a frame read from a client, once it is checked to be of a kind clients may send
+// and to carry the payload of that kind
+func dispatch(client *Client, proto Protocol) {
+	slog.Debug("chat", slog.Any("throb", proto.Typ), slog.Any("payload", proto.Message))
 
-		// Send it out to every client that is currently connected
-		for client := range clients {
+	// never pass on bearer tokens to other clients
+	proto.Token = ""
 
-			// is the client subscribed / permitted this message?
-			// TODO
+	presence.active(client)
 
-			err := client.WriteJSON(proto)
-			if err != nil {
-				slog.Error("unable to broadcast message", slog.Any("err", err))
-				client.Close()
-				delete(clients, client)
-			}
-		}
+	if perr := validate(proto); perr != nil {
+		slog.Warn("rejecting invalid frame", slog.String("type", proto.Type),
+			slog.String("userID", client.user.ID.String()), slog.Any("err", perr))
+		fail(client, proto, perr)
+		return
 	}
+	clientFrames[proto.Type].handle(client, proto)
 }
 
-func CheckAuth(r *http.Request) bool {
-	// oauth token present and valid?
-	// TODO
-	return true
+// postMessage persists a message; messages with an id are edits of existing ones, announced as such
+func postMessage(client *Client, proto Protocol, msg *content.Message) {
+	var err error
+	if msg.ID != uuid.Nil {
+		proto.Type = "edit"
+	}
+	*msg, err = content.SaveMessage(client.user, *msg) // use returned msg to get message id
+	if err != nil {
+		fail(client, proto, contentError(err, "unable to save message"))
+		return
+	}
+	proto.ChannelID, proto.Seq = msg.ChannelID, msg.Seq
+	if proto.Type == "msg" && msg.InReplyToID != nil {
+		notifyThread(*msg)
+	}
+	relay(client, proto)
+	pushUnread(msg.Mentions...)
+}
+
+// deleteMessage deletes a message of the user, leaving a tombstone for its audience
+func deleteMessage(client *Client, proto Protocol, msg *content.Message) {
+	var err error
+	*msg, err = content.DeleteMessage(client.user, msg.ID, msg.DeleteReason)
+	if err != nil {
+		fail(client, proto, contentError(err, "unable to delete message"))
+		return
+	}
+	proto.ID, proto.ChannelID, proto.Seq = msg.ID.String(), msg.ChannelID, msg.Seq
+	relay(client, proto)
+}
+
+// react adds or takes back a reaction of the user; reactions that change nothing aren't passed on
+func react(client *Client, proto Protocol, like *Like) {
+	reaction, changed, err := content.React(like.MessageID, client.user.ID, like.Emoji, like.Remove)
+	if err != nil {
+		fail(client, proto, contentError(err, "unable to save reaction"))
+		return
+	}
+	if !changed {
+		return
+	}
+	like.UserID, like.Email, like.Emoji = client.user.ID, client.user.Email, reaction.Emoji
+	if reaction.Seq != 0 {
+		proto.ChannelID, _ = content.MessageChannelID(reaction.MessageID)
+		proto.Seq = reaction.Seq
+	}
+	relay(client, proto)
+}
+
+// readMessage records that the user read a message
+func readMessage(client *Client, proto Protocol, read *Read) {
+	saved, err := content.ReadPost(read.MessageID, client.user.ID)
+	if err != nil {
+		fail(client, proto, contentError(err, "unable to save read"))
+		return
+	}
+	read.UserID, read.Email = client.user.ID, client.user.Email
+	if saved.Seq != 0 {
+		proto.ChannelID, _ = content.MessageChannelID(saved.MessageID)
+		proto.Seq = saved.Seq
+	}
+	relay(client, proto)
+	pushUnread(client.user.ID)
+}
+
+// relay passes a handled frame on to its audience
+func relay(client *Client, proto Protocol) {
+	ids, err := audience(proto, client.user)
+	if err != nil {
+		slog.Warn("dropping frame without audience", slog.String("type", proto.Type),
+			slog.String("userID", client.user.ID.String()), slog.Any("err", err))
+		fail(client, proto, &ProtocolError{Code: ErrCodeNotAllowed, Message: err.Error()})
+		return
+	}
+	publish(proto, ids)
 }
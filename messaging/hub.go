@@ -0,0 +1,293 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/users"
+	"encoding/json"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"time"
+)
+
+const (
+	// time allowed to write a frame to the peer
+	writeWait = 10 * time.Second
+
+	// time allowed to read the next pong from the peer
+	pongWait = 60 * time.Second
+
+	// send pings with this period, must be less than pongWait
+	pingPeriod = (pongWait * 9) / 10
+
+	// largest frame we accept from a peer
+	maxFrameSize = 64 * 1024
+
+	// frames queued per client before it is considered too slow and evicted
+	sendQueueSize = 256
+
+	// frames held back for a client during a replay before it is evicted; with the replay itself they
+	// have to fit the send queue once released
+	maxHeld = sendQueueSize / 4
+)
+
+// Hub owns the set of connected clients. Registration, unregistration and fan-out all happen
+// on the goroutine running Hub.run, so the client maps are never touched concurrently.
+type Hub struct {
+	clients    map[*Client]bool
+	byUser     map[uuid.UUID]map[*Client]bool
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan outbound
+}
+
+var hub = newHub()
+
+func newHub() *Hub {
+	return &Hub{
+		clients:    make(map[*Client]bool),
+		byUser:     make(map[uuid.UUID]map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan outbound, sendQueueSize),
+	}
+}
+
+// Client is a connection bound to the user that authenticated it. Frames for the client are
+// queued on send and written by the client's own writer goroutine. Event stream and long-poll
+// clients have no web socket connection.
+type Client struct {
+	hub  *Hub
+	conn *websocket.Conn
+	user users.User
+	send chan []byte
+
+	// owned by the hub goroutine; frames held back while missed frames are replayed, and the
+	// highest sequence number replayed per channel
+	holding  bool
+	held     []heldFrame
+	replayed map[uuid.UUID]uint64
+
+	// owned by the reader goroutine; rate limit buckets by frame type, and frames over the limit
+	buckets     map[string]*bucket
+	strikes     int
+	firstStrike time.Time
+}
+
+type heldFrame struct {
+	channelID *uuid.UUID
+	seq       uint64
+	data      []byte
+}
+
+func newClient(h *Hub, conn *websocket.Conn, user users.User) *Client {
+	return &Client{hub: h, conn: conn, user: user, send: make(chan []byte, sendQueueSize), buckets: make(map[string]*bucket)}
+}
+
+func (h *Hub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+			if h.byUser[client.user.ID] == nil {
+				h.byUser[client.user.ID] = make(map[*Client]bool)
+			}
+			h.byUser[client.user.ID][client] = true
+			slog.Debug("client registered", slog.String("userID", client.user.ID.String()), slog.Int("clients", len(h.clients)))
+		case client := <-h.unregister:
+			h.remove(client)
+		case out := <-h.broadcast:
+			h.deliver(out)
+		}
+	}
+}
+
+// remove drops a client and closes its send queue, which makes the writer goroutine hang up
+func (h *Hub) remove(client *Client) {
+	if !h.clients[client] {
+		return
+	}
+	delete(h.clients, client)
+	delete(h.byUser[client.user.ID], client)
+	if len(h.byUser[client.user.ID]) == 0 {
+		delete(h.byUser, client.user.ID)
+	}
+	close(client.send)
+	slog.Debug("client unregistered", slog.String("userID", client.user.ID.String()), slog.Int("clients", len(h.clients)))
+}
+
+func (h *Hub) deliver(out outbound) {
+	switch out.op {
+	case opHold:
+		out.client.holding = true
+		out.client.replayed = make(map[uuid.UUID]uint64)
+		return
+	case opRelease:
+		h.release(out.client)
+		return
+	}
+
+	data, err := json.Marshal(out.proto)
+	if err != nil {
+		slog.Error("unable to encode frame", slog.String("type", out.proto.Type), slog.Any("err", err))
+		return
+	}
+
+	if out.client != nil {
+		// replayed frames go out even while live frames are held back
+		if out.client.holding && out.proto.ChannelID != nil && out.proto.Seq > out.client.replayed[*out.proto.ChannelID] {
+			out.client.replayed[*out.proto.ChannelID] = out.proto.Seq
+		}
+		h.enqueue(out.client, data)
+		return
+	}
+
+	for userID := range out.audience {
+		for client := range h.byUser[userID] {
+			if client.holding {
+				h.hold(client, heldFrame{channelID: out.proto.ChannelID, seq: out.proto.Seq, data: data})
+			} else {
+				h.enqueue(client, data)
+			}
+		}
+	}
+}
+
+func (h *Hub) hold(client *Client, frame heldFrame) {
+	if len(client.held) >= maxHeld {
+		slog.Warn("evicting client holding too many frames", slog.String("userID", client.user.ID.String()))
+		h.remove(client)
+		return
+	}
+	client.held = append(client.held, frame)
+}
+
+// release delivers the frames held back during a replay, skipping those the replay already covered
+func (h *Hub) release(client *Client) {
+	held := client.held
+	replayed := client.replayed
+	client.holding = false
+	client.held = nil
+	client.replayed = nil
+
+	for _, frame := range held {
+		if frame.channelID != nil && frame.seq != 0 && frame.seq <= replayed[*frame.channelID] {
+			continue
+		}
+		h.enqueue(client, frame.data)
+	}
+}
+
+// enqueue never blocks the hub; a client whose queue is full is too slow to keep up and gets evicted
+func (h *Hub) enqueue(client *Client, data []byte) {
+	if !h.clients[client] {
+		return
+	}
+	select {
+	case client.send <- data:
+	default:
+		slog.Warn("evicting slow client", slog.String("userID", client.user.ID.String()))
+		h.remove(client)
+	}
+}
+
+// send hands a frame to the hub for delivery to its audience
+func (h *Hub) send(out outbound) {
+	h.broadcast <- out
+}
+
+// reply queues a frame for a single client
+func (h *Hub) reply(client *Client, proto Protocol) {
+	proto.V = ProtocolVersion
+	h.broadcast <- outbound{proto: proto, client: client}
+}
+
+// control queues an operation on a client, in order with the frames sent to it
+func (h *Hub) control(client *Client, op clientOp) {
+	h.broadcast <- outbound{client: client, op: op}
+}
+
+// disconnect unregisters a client, and once the user has no connections left, stops their typing
+// indicators and takes them out of calls
+func (c *Client) disconnect() {
+	c.hub.unregister <- c
+	if presence.disconnected(c) {
+		typing.disconnected(c.user.ID)
+		callsDisconnected(c.user.ID)
+		huddlesDisconnected(c.user.ID)
+	}
+}
+
+// readPump reads frames from the connection until it fails, passing each to the dispatcher
+func (c *Client) readPump() {
+	defer func() {
+		c.disconnect()
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				slog.Error("unable to read message", slog.String("userID", c.user.ID.String()), slog.Any("err", err))
+			}
+			return
+		}
+
+		// frames that don't decode are answered with an error, rather than hanging up
+		var proto Protocol
+		err = json.Unmarshal(data, &proto)
+
+		if limited, struckOut := limiter.limited(c, proto); struckOut {
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"), time.Now().Add(writeWait))
+			return
+		} else if limited {
+			continue
+		}
+
+		if err != nil {
+			slog.Warn("unable to decode frame", slog.String("userID", c.user.ID.String()), slog.Any("err", err))
+			fail(c, proto, &ProtocolError{Code: ErrCodeInvalidFrame, Message: err.Error()})
+			continue
+		}
+		dispatch(c, proto)
+	}
+}
+
+// writePump is the only goroutine writing to the connection. It writes queued frames and keeps the
+// connection alive with pings, and hangs up once the hub closes the send queue.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// the hub closed the queue, either after a read failure or because we were too slow
+				c.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "evicted"))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				slog.Error("unable to write message", slog.String("userID", c.user.ID.String()), slog.Any("err", err))
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
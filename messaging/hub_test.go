@@ -0,0 +1,104 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/users"
+	"encoding/json"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func testClient(h *Hub, queueSize int) *Client {
+	var user users.User
+	user.ID, _ = uuid.NewV4()
+	return &Client{hub: h, user: user, send: make(chan []byte, queueSize)}
+}
+
+// wait for the hub goroutine to process everything sent to it so far
+func flush(h *Hub) {
+	done := testClient(h, 1)
+	h.register <- done
+	h.unregister <- done
+}
+
+func TestHub_Deliver(t *testing.T) {
+	h := newHub()
+	go h.run()
+
+	alice := testClient(h, 4)
+	bob := testClient(h, 4)
+	h.register <- alice
+	h.register <- bob
+
+	h.send(newOutbound(Protocol{Type: "msg"}, []uuid.UUID{alice.user.ID}))
+	flush(h)
+
+	assert.Len(t, alice.send, 1, "frame should be delivered to audience")
+	assert.Len(t, bob.send, 0, "frame should not be delivered outside audience")
+}
+
+func TestHub_Unregister(t *testing.T) {
+	h := newHub()
+	go h.run()
+
+	alice := testClient(h, 4)
+	h.register <- alice
+	h.unregister <- alice
+	// unregistering twice, as happens when a slow client also fails to read, must be harmless
+	h.unregister <- alice
+	flush(h)
+
+	_, ok := <-alice.send
+	assert.False(t, ok, "send queue should be closed")
+}
+
+func TestHub_EvictSlowClient(t *testing.T) {
+	h := newHub()
+	go h.run()
+
+	slow := testClient(h, 1)
+	h.register <- slow
+
+	for i := 0; i < 3; i++ {
+		h.send(newOutbound(Protocol{Type: "msg"}, []uuid.UUID{slow.user.ID}))
+	}
+	flush(h)
+
+	select {
+	case <-slow.send:
+	case <-time.After(time.Second):
+		t.Fatal("expected queued frame")
+	}
+	_, ok := <-slow.send
+	assert.False(t, ok, "slow client should have been evicted")
+}
+
+func TestHub_HoldDuringReplay(t *testing.T) {
+	h := newHub()
+	go h.run()
+
+	alice := testClient(h, 8)
+	h.register <- alice
+
+	channelID, _ := uuid.NewV4()
+	h.control(alice, opHold)
+	// live frames arriving during the replay, one of them also part of the replay
+	h.send(newOutbound(Protocol{Type: "msg", ChannelID: &channelID, Seq: 2}, []uuid.UUID{alice.user.ID}))
+	h.send(newOutbound(Protocol{Type: "msg", ChannelID: &channelID, Seq: 3}, []uuid.UUID{alice.user.ID}))
+	flush(h)
+	assert.Len(t, alice.send, 0, "live frames should be held back during replay")
+
+	h.reply(alice, Protocol{Type: "msg", ChannelID: &channelID, Seq: 1})
+	h.reply(alice, Protocol{Type: "msg", ChannelID: &channelID, Seq: 2})
+	h.control(alice, opRelease)
+	flush(h)
+
+	var seqs []uint64
+	for len(alice.send) > 0 {
+		var proto Protocol
+		assert.NoError(t, json.Unmarshal(<-alice.send, &proto))
+		seqs = append(seqs, proto.Seq)
+	}
+	assert.Equal(t, []uint64{1, 2, 3}, seqs, "stream should be delivered in order without duplicates")
+}
@@ -0,0 +1,249 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	"areo/go-chat-backend/server"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Huddle is a group call inside a channel. A channel has at most one active huddle, which ends once
+// the last participant leaves.
+type Huddle struct {
+	ID          uuid.UUID   `json:"id" gorm:"type:char(36);primaryKey"`
+	ChannelID   uuid.UUID   `json:"channelId" gorm:"type:char(36);index"`
+	Active      *uuid.UUID  `json:"-" gorm:"type:char(36);uniqueIndex"` // the channel id while active, so only one can be
+	StartedByID uuid.UUID   `json:"startedById" gorm:"type:char(36)"`
+	StartedAt   time.Time   `json:"startedAt"`
+	EndedAt     *time.Time  `json:"endedAt,omitempty"`
+	Members     []uuid.UUID `json:"participants" gorm:"-"` // users currently in the huddle
+}
+
+// HuddleParticipant records a user joining, and leaving, a huddle
+type HuddleParticipant struct {
+	HuddleID uuid.UUID `gorm:"type:char(36);primaryKey"`
+	UserID   uuid.UUID `gorm:"type:char(36);primaryKey"`
+	JoinedAt time.Time
+	LeftAt   *time.Time `gorm:"index"`
+}
+
+// joinHuddle adds the user to the active huddle of a channel, starting one if there is none
+func joinHuddle(client *Client, proto Protocol) {
+	if proto.ChannelID == nil {
+		slog.Warn("ignoring join frame without channel", slog.String("userID", client.user.ID.String()))
+		return
+	}
+	channelID := *proto.ChannelID
+
+	ids, err := content.ChannelParticipantIDs(channelID)
+	if err != nil {
+		return
+	}
+	if _, err = visibleAudience(ids, client.user); err != nil {
+		slog.Warn("ignoring join of huddle in channel of others", slog.String("channelID", channelID.String()),
+			slog.String("userID", client.user.ID.String()))
+		fail(client, proto, &ProtocolError{Code: ErrCodeNotAllowed, Message: err.Error()})
+		return
+	}
+	if content.ChannelArchived(channelID) {
+		fail(client, proto, contentError(content.ErrChannelArchived, "unable to join huddle"))
+		return
+	}
+
+	var huddle Huddle
+	var started bool
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		id, _ := uuid.NewV4()
+		created := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Huddle{ID: id, ChannelID: channelID,
+			Active: &channelID, StartedByID: client.user.ID, StartedAt: time.Now()})
+		if created.Error != nil {
+			return created.Error
+		}
+		started = created.RowsAffected > 0
+
+		err := tx.Where("active = ?", channelID).First(&huddle).Error
+		if err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "huddle_id"}, {Name: "user_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"left_at": nil}),
+		}).Create(&HuddleParticipant{HuddleID: huddle.ID, UserID: client.user.ID, JoinedAt: time.Now()}).Error
+	})
+	if err != nil {
+		slog.Error("unable to join huddle", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return
+	}
+
+	if started {
+		recordHuddle(huddle, "huddle_started", ids)
+	}
+	announceHuddle(huddle, ids)
+}
+
+// leaveHuddle removes the user from the active huddle of a channel, ending it when the last one leaves
+func leaveHuddle(userID uuid.UUID, channelID uuid.UUID) {
+	var huddle Huddle
+	err := server.DB.Where("active = ?", channelID).First(&huddle).Error
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	err = server.DB.Model(&HuddleParticipant{}).Where("huddle_id = ? AND user_id = ? AND left_at IS NULL", huddle.ID, userID).
+		Update("left_at", now).Error
+	if err != nil {
+		slog.Error("unable to leave huddle", slog.String("huddleID", huddle.ID.String()), slog.Any("err", err))
+		return
+	}
+
+	ids, err := content.ChannelParticipantIDs(channelID)
+	if err != nil {
+		return
+	}
+
+	members, err := huddleMembers(huddle.ID, true)
+	if err != nil {
+		return
+	}
+	if len(members) == 0 {
+		// only one of several racing leaves gets to end the huddle
+		res := server.DB.Model(&Huddle{}).Where("id = ? AND active IS NOT NULL", huddle.ID).
+			Updates(map[string]interface{}{"active": nil, "ended_at": now})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return
+		}
+		huddle.Active, huddle.EndedAt = nil, &now
+		recordHuddle(huddle, "huddle_ended", ids)
+	}
+	announceHuddle(huddle, ids)
+}
+
+// huddlesDisconnected takes a user whose last socket has gone out of the huddles they are in
+func huddlesDisconnected(userID uuid.UUID) {
+	var channelIDs []uuid.UUID
+	err := server.DB.Model(&Huddle{}).
+		Joins("JOIN huddle_participants ON huddle_participants.huddle_id = huddles.id").
+		Where("huddles.active IS NOT NULL AND huddle_participants.user_id = ? AND huddle_participants.left_at IS NULL", userID).
+		Pluck("huddles.channel_id", &channelIDs).Error
+	if err != nil {
+		slog.Error("unable to load huddles of user", slog.String("userID", userID.String()), slog.Any("err", err))
+		return
+	}
+	for _, channelID := range channelIDs {
+		leaveHuddle(userID, channelID)
+	}
+}
+
+// purgeHuddles removes the huddles of a channel that is gone for good, telling those still in one it ended
+func purgeHuddles(channelID uuid.UUID) {
+	var huddles []Huddle
+	err := server.DB.Where("channel_id = ?", channelID).Find(&huddles).Error
+	if err != nil || len(huddles) == 0 {
+		return
+	}
+
+	var active *Huddle
+	var members []uuid.UUID
+	huddleIDs := make([]uuid.UUID, len(huddles))
+	for i := range huddles {
+		huddleIDs[i] = huddles[i].ID
+		if huddles[i].Active != nil {
+			active = &huddles[i]
+			members, _ = huddleMembers(active.ID, true)
+		}
+	}
+
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("huddle_id IN ?", huddleIDs).Delete(&HuddleParticipant{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", huddleIDs).Delete(&Huddle{}).Error
+	})
+	if err != nil {
+		slog.Error("unable to purge huddles", slog.String("channelID", channelID.String()), slog.Any("err", err))
+		return
+	}
+
+	if active != nil && len(members) > 0 {
+		now := time.Now()
+		active.Active, active.EndedAt, active.Members = nil, &now, []uuid.UUID{}
+		publish(Protocol{Type: "huddle", ChannelID: &channelID, Huddle: active}, members)
+	}
+}
+
+// relayHuddle passes mesh signaling between two participants of the active huddle of a channel
+func relayHuddle(client *Client, proto Protocol, call *Call) {
+	recipientID, err := uuid.FromString(call.RecipientID)
+	if err != nil {
+		slog.Warn("ignoring huddle signaling without recipient", slog.String("userID", client.user.ID.String()))
+		fail(client, proto, invalidField("call.recipientID", "huddle signaling needs the id of the recipient"))
+		return
+	}
+
+	var huddle Huddle
+	err = server.DB.Where("active = ?", *proto.ChannelID).First(&huddle).Error
+	if err != nil {
+		slog.Warn("ignoring signaling for channel without huddle", slog.String("channelID", proto.ChannelID.String()))
+		fail(client, proto, invalidField("channelId", "the channel has no huddle going on"))
+		return
+	}
+	members, err := huddleMembers(huddle.ID, true)
+	if err != nil {
+		fail(client, proto, &ProtocolError{Code: ErrCodeInternal, Message: "unable to load huddle participants"})
+		return
+	}
+	if !slices.Contains(members, client.user.ID) || !slices.Contains(members, recipientID) {
+		slog.Warn("ignoring signaling to or from outside the huddle", slog.String("huddleID", huddle.ID.String()),
+			slog.String("userID", client.user.ID.String()))
+		fail(client, proto, &ProtocolError{Code: ErrCodeNotAllowed, Message: "only participants of a huddle signal each other"})
+		return
+	}
+
+	call.ID = huddle.ID
+	forward(proto, recipientID)
+}
+
+// huddleMembers returns the users in a huddle, or everyone that ever joined it
+func huddleMembers(huddleID uuid.UUID, present bool) (ids []uuid.UUID, err error) {
+	query := server.DB.Model(&HuddleParticipant{}).Where("huddle_id = ?", huddleID)
+	if present {
+		query = query.Where("left_at IS NULL")
+	}
+	err = query.Order("joined_at").Pluck("user_id", &ids).Error
+	if err != nil {
+		slog.Error("unable to load huddle participants", slog.String("huddleID", huddleID.String()), slog.Any("err", err))
+	}
+	return
+}
+
+// announceHuddle sends the live participant list of a huddle to the channel
+func announceHuddle(huddle Huddle, audience []uuid.UUID) {
+	huddle.Members, _ = huddleMembers(huddle.ID, true)
+	publish(Protocol{Type: "huddle", ChannelID: &huddle.ChannelID, Huddle: &huddle}, audience)
+}
+
+// recordHuddle posts a system message to the channel of a huddle, listing everyone that joined it
+func recordHuddle(huddle Huddle, flags string, audience []uuid.UUID) {
+	members, err := huddleMembers(huddle.ID, false)
+	if err != nil {
+		return
+	}
+	participants := make([]string, 0, len(members))
+	for _, id := range members {
+		participants = append(participants, id.String())
+	}
+
+	msg, err := content.SaveSystemMessage(content.Message{UserID: huddle.StartedByID, ChannelID: &huddle.ChannelID,
+		MessageType: "system", SystemFlags: flags, Message: strings.Join(participants, ",")})
+	if err != nil {
+		slog.Error("unable to record huddle", slog.String("huddleID", huddle.ID.String()), slog.Any("err", err))
+		return
+	}
+	publish(Protocol{Type: "msg", ID: msg.ID.String(), ChannelID: msg.ChannelID, Seq: msg.Seq, Message: &msg}, audience)
+}
@@ -0,0 +1,336 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm/clause"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceIdle    = "idle"
+	PresenceOffline = "offline"
+
+	// users that haven't sent a frame for this long are considered idle
+	idleAfter = 5 * time.Minute
+
+	// how often we look for idle users and refresh the presence rows of this instance
+	presenceHeartbeat = 30 * time.Second
+
+	// presence rows not refreshed for this long belong to an instance that has gone away
+	presenceStaleAfter = 2 * time.Minute
+
+	// max number of users in a bulk presence lookup
+	maxPresenceLookup = 200
+)
+
+// Presence is the presence of a user, as sent in presence frames and returned by the bulk lookup
+type Presence struct {
+	UserID   uuid.UUID  `json:"userId"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// NodePresence is the presence of a user on a single backend instance. Each instance keeps rows for
+// the users connected to it, so that the presence of a user can be worked out across instances.
+type NodePresence struct {
+	UserID    uuid.UUID `gorm:"type:char(36);primaryKey"`
+	NodeID    string    `gorm:"type:char(36);primaryKey"`
+	Status    string    `gorm:"type:char(16)"`
+	Sockets   int
+	UpdatedAt time.Time `gorm:"index"`
+}
+
+// userPresence is what this instance knows about a connected user
+type userPresence struct {
+	sockets    map[*Client]string // status reported by each socket
+	lastActive time.Time
+	status     string // status last stored for this instance
+}
+
+type presenceChange struct {
+	userID  uuid.UUID
+	status  string
+	sockets int
+}
+
+// presenceTracker tracks the users connected to this instance. Changes are stored and announced
+// in order by the goroutine running presenceTracker.run.
+type presenceTracker struct {
+	mu      sync.Mutex
+	nodeID  string
+	users   map[uuid.UUID]*userPresence
+	changes chan presenceChange
+}
+
+var presence = newPresenceTracker()
+
+func newPresenceTracker() *presenceTracker {
+	nodeID, _ := uuid.NewV4()
+	return &presenceTracker{
+		nodeID:  nodeID.String(),
+		users:   make(map[uuid.UUID]*userPresence),
+		changes: make(chan presenceChange, sendQueueSize),
+	}
+}
+
+func (t *presenceTracker) connected(client *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	up := t.users[client.user.ID]
+	if up == nil {
+		up = &userPresence{sockets: make(map[*Client]string), status: PresenceOffline}
+		t.users[client.user.ID] = up
+	}
+	up.sockets[client] = PresenceOnline
+	up.lastActive = time.Now()
+	t.update(client.user.ID, up)
+}
+
+// disconnected drops the socket of a client, returning whether it was the last one of the user
+func (t *presenceTracker) disconnected(client *Client) (gone bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	up := t.users[client.user.ID]
+	if up == nil {
+		return true
+	}
+	delete(up.sockets, client)
+	t.update(client.user.ID, up)
+	if len(up.sockets) == 0 {
+		delete(t.users, client.user.ID)
+		return true
+	}
+	return false
+}
+
+// active records that a client sent a frame
+func (t *presenceTracker) active(client *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if up := t.users[client.user.ID]; up != nil {
+		up.lastActive = time.Now()
+		t.update(client.user.ID, up)
+	}
+}
+
+// report sets the status a client reports for its socket, e.g. idle when the app is in the background
+func (t *presenceTracker) report(client *Client, status string) {
+	if status != PresenceOnline && status != PresenceIdle {
+		slog.Warn("ignoring unknown presence status", slog.String("status", status))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if up := t.users[client.user.ID]; up != nil {
+		up.sockets[client] = status
+		t.update(client.user.ID, up)
+	}
+}
+
+// update works out the status of a user on this instance and queues a change if it differs from
+// what was stored last. Must be called with the lock held.
+func (t *presenceTracker) update(userID uuid.UUID, up *userPresence) {
+	status := PresenceOffline
+	for _, reported := range up.sockets {
+		if reported == PresenceOnline && time.Since(up.lastActive) < idleAfter {
+			status = PresenceOnline
+			break
+		}
+		status = PresenceIdle
+	}
+	if status == up.status {
+		return
+	}
+	up.status = status
+	t.changes <- presenceChange{userID: userID, status: status, sockets: len(up.sockets)}
+}
+
+// run stores and announces presence changes, in the order they happened
+func (t *presenceTracker) run() {
+	go t.heartbeat()
+
+	for change := range t.changes {
+		t.store(change)
+		t.announce(change.userID)
+	}
+}
+
+// heartbeat periodically marks users that have gone quiet as idle, and refreshes the rows of this
+// instance so other instances know we are still around
+func (t *presenceTracker) heartbeat() {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		t.mu.Lock()
+		connected := make([]uuid.UUID, 0, len(t.users))
+		for userID, up := range t.users {
+			t.update(userID, up)
+			connected = append(connected, userID)
+		}
+		t.mu.Unlock()
+
+		err := server.DB.Model(&NodePresence{}).Where("node_id = ?", t.nodeID).Update("updated_at", now).Error
+		if err != nil {
+			slog.Error("unable to refresh presence", slog.Any("err", err))
+		}
+		if len(connected) > 0 {
+			err = server.DB.Model(&users.User{}).Where("id IN ?", connected).Update("last_seen", now).Error
+			if err != nil {
+				slog.Error("unable to update last seen", slog.Any("err", err))
+			}
+		}
+		err = server.DB.Where("updated_at < ?", now.Add(-presenceStaleAfter)).Delete(&NodePresence{}).Error
+		if err != nil {
+			slog.Error("unable to remove stale presence", slog.Any("err", err))
+		}
+	}
+}
+
+// store persists the status of a user on this instance, along with the last seen timestamp
+func (t *presenceTracker) store(change presenceChange) {
+	var err error
+	now := time.Now()
+
+	if change.status == PresenceOffline {
+		err = server.DB.Where("user_id = ? AND node_id = ?", change.userID, t.nodeID).Delete(&NodePresence{}).Error
+	} else {
+		row := NodePresence{UserID: change.userID, NodeID: t.nodeID, Status: change.status, Sockets: change.sockets, UpdatedAt: now}
+		err = server.DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "node_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"status", "sockets", "updated_at"}),
+		}).Create(&row).Error
+	}
+	if err != nil {
+		slog.Error("unable to store presence", slog.String("userID", change.userID.String()), slog.Any("err", err))
+	}
+
+	err = server.DB.Model(&users.User{}).Where("id = ?", change.userID).Update("last_seen", now).Error
+	if err != nil {
+		slog.Error("unable to update last seen", slog.String("userID", change.userID.String()), slog.Any("err", err))
+	}
+}
+
+// announce sends the presence of a user, across all instances, to the users sharing a channel with them
+func (t *presenceTracker) announce(userID uuid.UUID) {
+	presences, err := LookupPresence([]uuid.UUID{userID})
+	if err != nil || len(presences) == 0 {
+		return
+	}
+
+	ids, err := content.CoParticipantIDs(userID)
+	if err != nil {
+		return
+	}
+	publish(Protocol{Type: "presence", Presence: &presences[0]}, append(ids, userID))
+}
+
+// rank orders statuses, so the presence of a user connected to several instances is the most present one
+var rank = map[string]int{PresenceOffline: 0, PresenceIdle: 1, PresenceOnline: 2}
+
+// LookupPresence returns the presence of the given users across all instances
+func LookupPresence(ids []uuid.UUID) (presences []Presence, err error) {
+
+	var rows []NodePresence
+	err = server.DB.Where("user_id IN ? AND updated_at > ?", ids, time.Now().Add(-presenceStaleAfter)).Find(&rows).Error
+	if err != nil {
+		slog.Error("unable to look up presence", slog.Any("err", err))
+		return nil, err
+	}
+
+	var found []users.User
+	err = server.DB.Select("id", "last_seen").Where("id IN ?", ids).Find(&found).Error
+	if err != nil {
+		slog.Error("unable to look up last seen", slog.Any("err", err))
+		return nil, err
+	}
+
+	statuses := make(map[uuid.UUID]string)
+	for _, row := range rows {
+		if rank[row.Status] > rank[statuses[row.UserID]] {
+			statuses[row.UserID] = row.Status
+		}
+	}
+
+	presences = make([]Presence, 0, len(found))
+	for _, user := range found {
+		status := statuses[user.ID]
+		if status == "" {
+			status = PresenceOffline
+		}
+		presences = append(presences, Presence{UserID: user.ID, Status: status, LastSeen: user.LastSeen})
+	}
+	return presences, nil
+}
+
+// GetPresence is the bulk presence lookup, taking a comma separated list of user ids. Users only see
+// themselves and the users they share a channel with.
+func GetPresence(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	var ids []uuid.UUID
+	for _, v := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		id, err := uuid.FromString(strings.TrimSpace(v))
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 || len(ids) > maxPresenceLookup {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"status": "error", "err": "provide between 1 and 200 user ids"})
+		return
+	}
+
+	visible, err := content.CoParticipantIDs(user.ID)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	for _, id := range ids {
+		if id != user.ID && !slices.Contains(visible, id) {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, render.M{"status": "error", "err": "no channel in common with user " + id.String()})
+			return
+		}
+	}
+
+	presences, err := LookupPresence(ids)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	render.JSON(w, r, render.M{"items": presences})
+}
+
+func InitSchema() {
+	slog.Info("setting up messaging schema")
+	err := server.DB.AutoMigrate(&NodePresence{}, &CallSession{}, &Huddle{}, &HuddleParticipant{})
+	if err != nil {
+		slog.Error("unable to setup messaging schema", slog.Any("err", err))
+	}
+}
@@ -0,0 +1,245 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	_ "embed"
+	"errors"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// ProtocolVersion is the version of the frame protocol spoken by this server, negotiated as the
+// chat.v<version> web socket subprotocol. Clients that don't ask for a subprotocol get the same frames.
+const ProtocolVersion = 1
+
+var subprotocols = []string{"chat.v1"}
+
+// Schema is the JSON schema describing every frame of the protocol, for generating client SDKs
+//
+//go:embed protocol.schema.json
+var Schema []byte
+
+const (
+	ErrCodeInvalidFrame   = "invalid_frame"   // the frame couldn't be decoded
+	ErrCodeUnknownType    = "unknown_type"    // clients can't send frames of this type
+	ErrCodeMissingPayload = "missing_payload" // the payload for the frame type is missing
+	ErrCodeInvalidField   = "invalid_field"   // a field of the payload is missing or malformed
+	ErrCodeNotAllowed     = "not_allowed"     // the user isn't allowed to do this
+	ErrCodeInternal       = "internal"        // the server failed to handle the frame
+	ErrCodeRateLimited    = "rate_limited"    // the client sends frames of this type too fast
+)
+
+// ProtocolError is the payload of error frames, sent back to the client that sent the offending frame
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func invalidField(field string, message string) *ProtocolError {
+	return &ProtocolError{Code: ErrCodeInvalidField, Message: message, Field: field}
+}
+
+func missingPayload(field string) *ProtocolError {
+	return &ProtocolError{Code: ErrCodeMissingPayload, Message: "frame needs a " + field + " payload", Field: field}
+}
+
+// clientFrame is a kind of frame clients may send: how to check it, and how to handle it once checked
+type clientFrame struct {
+	check  func(Protocol) *ProtocolError
+	handle func(*Client, Protocol)
+}
+
+// bare describes a frame without a payload of its own, checked by check if not nil
+func bare(check func(Protocol) *ProtocolError, handle func(*Client, Protocol)) clientFrame {
+	if check == nil {
+		check = func(Protocol) *ProtocolError { return nil }
+	}
+	return clientFrame{check: check, handle: handle}
+}
+
+// typed describes a frame carrying a payload of type P, found in the envelope by payload. Frames without
+// the payload are rejected, so check, if not nil, and handle always get one to work with.
+func typed[P any](field string, payload func(Protocol) *P, check func(Protocol, *P) *ProtocolError,
+	handle func(*Client, Protocol, *P)) clientFrame {
+	return clientFrame{
+		check: func(proto Protocol) *ProtocolError {
+			p := payload(proto)
+			if p == nil {
+				return missingPayload(field)
+			}
+			if check == nil {
+				return nil
+			}
+			return check(proto, p)
+		},
+		handle: func(client *Client, proto Protocol) {
+			handle(client, proto, payload(proto))
+		},
+	}
+}
+
+// the payloads of the frame kinds
+func messagePayload(proto Protocol) *content.Message { return proto.Message }
+func typingPayload(proto Protocol) *Typing           { return proto.Typ }
+func callPayload(proto Protocol) *Call               { return proto.Call }
+func likePayload(proto Protocol) *Like               { return proto.Like }
+func readPayload(proto Protocol) *Read               { return proto.Read }
+func presencePayload(proto Protocol) *Presence       { return proto.Presence }
+
+// signalFrame checks the payload shared by the signaling frames, which either refer to a one-to-one call
+// by id, or to a participant of the huddle in the channel of the frame
+func signalFrame(proto Protocol, call *Call) *ProtocolError {
+	if proto.ChannelID != nil {
+		if _, err := uuid.FromString(call.RecipientID); err != nil {
+			return invalidField("call.recipientID", "huddle signaling needs the id of the recipient")
+		}
+		return nil
+	}
+	if call.ID == uuid.Nil {
+		return invalidField("call.id", "signaling needs the id of the call")
+	}
+	return nil
+}
+
+// huddleFrame checks that a frame joining or leaving a huddle names its channel
+func huddleFrame(proto Protocol) *ProtocolError {
+	if proto.ChannelID == nil {
+		return invalidField("channelId", "huddles need a channel")
+	}
+	return nil
+}
+
+// clientFrames holds the frame kinds clients may send, with the payload each of them carries
+var clientFrames = map[string]clientFrame{
+	"auth": bare(nil, func(client *Client, proto Protocol) {
+		slog.Debug("ignoring auth frame on authenticated socket", slog.String("userID", client.user.ID.String()))
+	}),
+	"presence": typed("presence", presencePayload, func(proto Protocol, p *Presence) *ProtocolError {
+		if p.Status != PresenceOnline && p.Status != PresenceIdle {
+			return invalidField("presence.status", "status must be online or idle")
+		}
+		return nil
+	}, func(client *Client, proto Protocol, p *Presence) {
+		// clients report their own status, which is announced once the presence of the user changes
+		presence.report(client, p.Status)
+	}),
+	"ack": bare(func(proto Protocol) *ProtocolError {
+		if proto.ChannelID == nil || proto.Seq == 0 {
+			return invalidField("seq", "acks need a channel and a sequence number")
+		}
+		return nil
+	}, ack),
+	"resume": bare(nil, resume),
+	"unread": bare(nil, replyUnread),
+	"msg": typed("message", messagePayload, func(proto Protocol, msg *content.Message) *ProtocolError {
+		if msg.ChannelID == nil && msg.RecipientID == nil && msg.InReplyToID == nil && msg.ID == uuid.Nil {
+			return invalidField("message.channelId", "messages need a channel, a recipient or a message to reply to")
+		}
+		return nil
+	}, postMessage),
+	"delete": typed("message", messagePayload, func(proto Protocol, msg *content.Message) *ProtocolError {
+		if msg.ID == uuid.Nil {
+			return invalidField("message.id", "deletes need the id of a message")
+		}
+		return nil
+	}, deleteMessage),
+	"typ": typed("typing", typingPayload, func(proto Protocol, typ *Typing) *ProtocolError {
+		if typ.ID == uuid.Nil {
+			return invalidField("typing.id", "typing needs the id of a channel, message or user")
+		}
+		return nil
+	}, func(client *Client, proto Protocol, typ *Typing) {
+		// typing frames are throttled and expired by the tracker, which passes them on
+		typing.typed(client, typ)
+	}),
+	"react": typed("like", likePayload, func(proto Protocol, like *Like) *ProtocolError {
+		if like.MessageID == uuid.Nil {
+			return invalidField("like.id", "reactions need the id of a message")
+		}
+		return nil
+	}, react),
+	"read": typed("read", readPayload, func(proto Protocol, read *Read) *ProtocolError {
+		if read.MessageID == uuid.Nil {
+			return invalidField("read.id", "reads need the id of a message")
+		}
+		return nil
+	}, readMessage),
+	"call": typed("call", callPayload, func(proto Protocol, call *Call) *ProtocolError {
+		if _, err := uuid.FromString(call.RecipientID); err != nil {
+			return invalidField("call.recipientID", "calls need the id of the recipient")
+		}
+		return nil
+	}, signal),
+	"answer":    typed("call", callPayload, signalFrame, signal),
+	"candidate": typed("call", callPayload, signalFrame, signal),
+	"reject":    typed("call", callPayload, signalFrame, signal),
+	"hangup":    typed("call", callPayload, signalFrame, signal),
+	"join":      bare(huddleFrame, joinHuddle),
+	"leave": bare(huddleFrame, func(client *Client, proto Protocol) {
+		leaveHuddle(client.user.ID, *proto.ChannelID)
+	}),
+}
+
+// contentError turns an error from saving content into an error frame, telling users what they aren't
+// allowed to do, but not the details of what went wrong on the server
+func contentError(err error, message string) *ProtocolError {
+	if errors.Is(err, content.ErrNotParticipant) || errors.Is(err, content.ErrNotAuthor) ||
+		errors.Is(err, content.ErrMessageDeleted) || errors.Is(err, content.ErrChannelArchived) {
+		return &ProtocolError{Code: ErrCodeNotAllowed, Message: err.Error()}
+	}
+	if errors.Is(err, content.ErrInvalidEmoji) {
+		return invalidField("like.emoji", err.Error())
+	}
+	if errors.Is(err, content.ErrNoTarget) {
+		return invalidField("message.channelId", err.Error())
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return invalidField("message.id", "no such message")
+	}
+	slog.Error(message, slog.Any("error", err))
+	return &ProtocolError{Code: ErrCodeInternal, Message: message}
+}
+
+// validate checks that a frame from a client is of a known type and carries the payload of that type
+func validate(proto Protocol) *ProtocolError {
+	frame, ok := clientFrames[proto.Type]
+	if !ok {
+		return &ProtocolError{Code: ErrCodeUnknownType, Message: "unknown frame type " + proto.Type, Field: "type"}
+	}
+	return frame.check(proto)
+}
+
+// fail sends an error frame back to the client, correlated with the frame that caused it
+func fail(client *Client, proto Protocol, err *ProtocolError) {
+	hub.reply(client, Protocol{Type: "error", Ref: proto.Ref, Error: err})
+}
+
+// negotiate picks the protocol version from the subprotocols offered in the handshake. Offering only
+// versions we don't speak is an error; offering none gets the current version.
+func negotiate(r *http.Request) bool {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		return true
+	}
+	for _, v := range offered {
+		if slices.Contains(subprotocols, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetProtocolSchema serves the JSON schema of the protocol
+func GetProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(Schema)
+}
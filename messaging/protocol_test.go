@@ -0,0 +1,65 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	"encoding/json"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	id, _ := uuid.NewV4()
+
+	tests := []struct {
+		name  string
+		proto Protocol
+		code  string
+	}{
+		{"unknown type", Protocol{Type: "bogus"}, ErrCodeUnknownType},
+		{"react without like", Protocol{Type: "react"}, ErrCodeMissingPayload},
+		{"react without message", Protocol{Type: "react", Like: &Like{}}, ErrCodeInvalidField},
+		{"react", Protocol{Type: "react", Like: &Like{MessageID: id}}, ""},
+		{"msg without target", Protocol{Type: "msg", Message: &content.Message{}}, ErrCodeInvalidField},
+		{"msg", Protocol{Type: "msg", Message: &content.Message{ChannelID: &id}}, ""},
+		{"delete without message id", Protocol{Type: "delete", Message: &content.Message{ChannelID: &id}}, ErrCodeInvalidField},
+		{"typing without typing", Protocol{Type: "typ"}, ErrCodeMissingPayload},
+		{"hangup without call", Protocol{Type: "hangup"}, ErrCodeMissingPayload},
+		{"answer without call id", Protocol{Type: "answer", Call: &Call{}}, ErrCodeInvalidField},
+		{"huddle answer", Protocol{Type: "answer", ChannelID: &id, Call: &Call{RecipientID: id.String()}}, ""},
+		{"presence with unknown status", Protocol{Type: "presence", Presence: &Presence{Status: "away"}}, ErrCodeInvalidField},
+		{"ack without seq", Protocol{Type: "ack", ChannelID: &id}, ErrCodeInvalidField},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(tt.proto)
+			if tt.code == "" {
+				assert.Nil(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.Equal(t, tt.code, err.Code)
+			}
+		})
+	}
+}
+
+func TestSchemaCoversClientFrames(t *testing.T) {
+	var schema struct {
+		Defs map[string]struct {
+			Properties struct {
+				Type struct {
+					Const string `json:"const"`
+				} `json:"type"`
+			} `json:"properties"`
+		} `json:"$defs"`
+	}
+	assert.NoError(t, json.Unmarshal(Schema, &schema))
+
+	for frameType := range clientFrames {
+		def, ok := schema.Defs[strings.ToUpper(frameType[:1])+frameType[1:]+"Frame"]
+		if assert.True(t, ok, "schema should describe %s frames", frameType) {
+			assert.Equal(t, frameType, def.Properties.Type.Const)
+		}
+	}
+}
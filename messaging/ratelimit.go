@@ -0,0 +1,213 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/users"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rate limited frames within strikeWindow before a connection is hung up on
+	maxStrikes   = 10
+	strikeWindow = time.Minute
+
+	// user buckets untouched for this long are full again and can be dropped
+	bucketIdle = 10 * time.Minute
+)
+
+// rateLimit is a token bucket refilling at rate tokens per second, holding at most burst tokens
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+// default limits per connection, by frame type or REST action; "*" covers everything else. Users get
+// twice these across their connections and REST calls, to allow for a couple of devices.
+var defaultLimits = map[string]rateLimit{
+	"msg":       {rate: 1, burst: 10},
+	"typ":       {rate: 2, burst: 5},
+	"react":     {rate: 2, burst: 10},
+	"read":      {rate: 5, burst: 20},
+	"candidate": {rate: 20, burst: 50},
+	"post":      {rate: 0.2, burst: 5},
+	"channel":   {rate: 0.2, burst: 5},
+	"*":         {rate: 5, burst: 20},
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token from the bucket if there is one, returning how long until there will be otherwise
+func (b *bucket) take(limit rateLimit, now time.Time) (ok bool, retryAfter time.Duration) {
+	b.tokens = math.Min(limit.burst, b.tokens+now.Sub(b.last).Seconds()*limit.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.rate * float64(time.Second))
+}
+
+type userBucketKey struct {
+	userID uuid.UUID
+	kind   string
+}
+
+// Limiter holds the rate limits, and the buckets of the users of this instance. Connection buckets
+// live on the connection, which only its reader goroutine touches.
+type Limiter struct {
+	mu         sync.Mutex
+	connLimits map[string]rateLimit
+	userLimits map[string]rateLimit
+	users      map[userBucketKey]*bucket
+	now        func() time.Time
+}
+
+// the limiter in use, with the default limits until Configure reads them from the environment
+var limiter = NewLimiter("", "")
+
+// SetLimiter replaces the limiter, and with it the buckets of all users. Set it up before serving.
+func SetLimiter(l *Limiter) {
+	limiter = l
+}
+
+// NewLimiter sets up the limits, overriding the defaults with comma separated kind=rate/burst lists,
+// e.g. "msg=1/10,typ=2/5", with the rate in tokens per second
+func NewLimiter(connLimits, userLimits string) *Limiter {
+	l := &Limiter{
+		connLimits: make(map[string]rateLimit),
+		userLimits: make(map[string]rateLimit),
+		users:      make(map[userBucketKey]*bucket),
+		now:        time.Now,
+	}
+	for kind, limit := range defaultLimits {
+		l.connLimits[kind] = limit
+		l.userLimits[kind] = rateLimit{rate: 2 * limit.rate, burst: 2 * limit.burst}
+	}
+	parseLimits(connLimits, l.connLimits)
+	parseLimits(userLimits, l.userLimits)
+	return l
+}
+
+func parseLimits(config string, limits map[string]rateLimit) {
+	for _, v := range strings.Split(config, ",") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		kind, spec, _ := strings.Cut(strings.TrimSpace(v), "=")
+		rate, burst, _ := strings.Cut(spec, "/")
+		r, err1 := strconv.ParseFloat(rate, 64)
+		b, err2 := strconv.ParseFloat(burst, 64)
+		if err1 != nil || err2 != nil || r <= 0 || b < 1 {
+			slog.Warn("ignoring invalid rate limit", slog.String("limit", v))
+			continue
+		}
+		limits[kind] = rateLimit{rate: r, burst: b}
+	}
+}
+
+// kindOf returns the kind a bucket is kept under; kinds without a limit of their own share the "*" bucket,
+// so that clients can't get fresh buckets by making up frame types
+func kindOf(limits map[string]rateLimit, kind string) string {
+	if _, ok := limits[kind]; ok {
+		return kind
+	}
+	return "*"
+}
+
+func limitFor(limits map[string]rateLimit, kind string) rateLimit {
+	return limits[kindOf(limits, kind)]
+}
+
+// allowUser takes a token from the bucket of a user
+func (l *Limiter) allowUser(userID uuid.UUID, kind string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	kind = kindOf(l.userLimits, kind)
+	key := userBucketKey{userID: userID, kind: kind}
+	b := l.users[key]
+	if b == nil {
+		limit := limitFor(l.userLimits, kind)
+		b = &bucket{tokens: limit.burst, last: now}
+		l.users[key] = b
+
+		// the map is swept of idle buckets as it grows, rather than on a timer
+		if len(l.users)%1024 == 0 {
+			for k, v := range l.users {
+				if now.Sub(v.last) > bucketIdle {
+					delete(l.users, k)
+				}
+			}
+		}
+	}
+	return b.take(limitFor(l.userLimits, kind), now)
+}
+
+// allowConn takes a token from the bucket of a connection, and from that of its user
+func (l *Limiter) allowConn(client *Client, kind string) (bool, time.Duration) {
+	now := l.now()
+	connKind := kindOf(l.connLimits, kind)
+	b := client.buckets[connKind]
+	if b == nil {
+		b = &bucket{tokens: limitFor(l.connLimits, connKind).burst, last: now}
+		client.buckets[connKind] = b
+	}
+	if ok, retryAfter := b.take(limitFor(l.connLimits, connKind), now); !ok {
+		return false, retryAfter
+	}
+	return l.allowUser(client.user.ID, kind)
+}
+
+// limited checks a frame read from a client against the limits. Frames over the limit are answered
+// with an error frame; a client that keeps going gets a strike for each, and is hung up on once it
+// has struck out.
+func (l *Limiter) limited(client *Client, proto Protocol) (limited bool, struckOut bool) {
+	ok, retryAfter := l.allowConn(client, proto.Type)
+	if ok {
+		return false, false
+	}
+
+	now := l.now()
+	if now.Sub(client.firstStrike) > strikeWindow {
+		client.firstStrike, client.strikes = now, 0
+	}
+	client.strikes++
+	if client.strikes > maxStrikes {
+		slog.Warn("disconnecting client exceeding rate limits", slog.String("userID", client.user.ID.String()))
+		return true, true
+	}
+
+	slog.Debug("rate limiting frame", slog.String("type", proto.Type), slog.String("userID", client.user.ID.String()))
+	fail(client, proto, &ProtocolError{Code: ErrCodeRateLimited,
+		Message: "slow down, retry in " + retryAfter.Round(time.Millisecond).String(), Field: "type"})
+	return true, false
+}
+
+// RateLimit limits REST calls of the logged in user, sharing the buckets of the user with the web socket
+func RateLimit(kind string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value("loggedInUser").(users.User)
+			if ok {
+				if allowed, retryAfter := limiter.allowUser(user.ID, kind); !allowed {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					render.Status(r, http.StatusTooManyRequests)
+					render.JSON(w, r, render.M{"status": "error", "err": "rate limit exceeded"})
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/users"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limit := rateLimit{rate: 2, burst: 3}
+	b := &bucket{tokens: limit.burst, last: now}
+
+	for i := 0; i < 3; i++ {
+		ok, _ := b.take(limit, now)
+		assert.True(t, ok, "the burst should be allowed")
+	}
+	ok, retryAfter := b.take(limit, now)
+	assert.False(t, ok, "the bucket should be empty after the burst")
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	ok, _ = b.take(limit, now.Add(500*time.Millisecond))
+	assert.True(t, ok, "the bucket should have refilled a token")
+}
+
+func TestParseLimits(t *testing.T) {
+	l := NewLimiter("msg=0.5/2, typ=bogus,read=0/5", "msg=3/7")
+
+	assert.Equal(t, rateLimit{rate: 0.5, burst: 2}, l.connLimits["msg"])
+	assert.Equal(t, defaultLimits["typ"], l.connLimits["typ"], "invalid limits should be ignored")
+	assert.Equal(t, defaultLimits["read"], l.connLimits["read"], "a zero rate should be ignored")
+	assert.Equal(t, rateLimit{rate: 3, burst: 7}, l.userLimits["msg"])
+	assert.Equal(t, rateLimit{rate: 2 * defaultLimits["react"].rate, burst: 2 * defaultLimits["react"].burst}, l.userLimits["react"])
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := NewLimiter("msg=1/2", "msg=1/3")
+	l.now = func() time.Time { return now }
+
+	var user users.User
+	user.ID, _ = uuid.NewV4()
+	first := &Client{user: user, buckets: make(map[string]*bucket)}
+	second := &Client{user: user, buckets: make(map[string]*bucket)}
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.allowConn(first, "msg")
+		assert.True(t, ok)
+	}
+	ok, _ := l.allowConn(first, "msg")
+	assert.False(t, ok, "the connection should be over its limit")
+
+	ok, _ = l.allowConn(second, "msg")
+	assert.True(t, ok, "another connection should have its own bucket")
+	ok, _ = l.allowConn(second, "msg")
+	assert.False(t, ok, "the user should be over their limit across connections")
+
+	ok, _ = l.allowConn(second, "typ")
+	assert.True(t, ok, "other frame types should have their own buckets")
+
+	now = now.Add(time.Second)
+	ok, _ = l.allowConn(second, "msg")
+	assert.True(t, ok, "the buckets should refill over time")
+}
+
+func TestUnknownTypesShareBucket(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter("*=1/2", "*=1/10")
+	l.now = func() time.Time { return now }
+
+	var user users.User
+	user.ID, _ = uuid.NewV4()
+	client := &Client{user: user, buckets: make(map[string]*bucket)}
+
+	for _, kind := range []string{"junk1", "junk2"} {
+		ok, _ := l.allowConn(client, kind)
+		assert.True(t, ok)
+	}
+	ok, _ := l.allowConn(client, "junk3")
+	assert.False(t, ok, "made up frame types should share the default bucket")
+	assert.Len(t, client.buckets, 1)
+	assert.Len(t, l.users, 1)
+}
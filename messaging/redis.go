@@ -0,0 +1,68 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"sync"
+)
+
+// RedisBroker distributes frames between instances using redis pub/sub. Frames are published to a
+// single redis channel that every instance subscribes to.
+type RedisBroker struct {
+	client  *redis.Client
+	channel string
+
+	mu   sync.Mutex
+	subs []*redis.PubSub
+}
+
+func NewRedisBroker(client *redis.Client, channel string) *RedisBroker {
+	return &RedisBroker{client: client, channel: channel}
+}
+
+func (b *RedisBroker) Publish(env Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), b.channel, data).Err()
+}
+
+func (b *RedisBroker) Subscribe(handler func(Envelope)) error {
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, b.channel)
+
+	// wait for the subscription to be confirmed, so nothing published after we return is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	b.mu.Lock()
+	b.subs = append(b.subs, pubsub)
+	b.mu.Unlock()
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			var env Envelope
+			if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+				slog.Error("unable to decode frame from redis", slog.Any("err", err))
+				continue
+			}
+			handler(env)
+		}
+	}()
+	return nil
+}
+
+func (b *RedisBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, pubsub := range b.subs {
+		pubsub.Close()
+	}
+	b.subs = nil
+	return b.client.Close()
+}
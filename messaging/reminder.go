@@ -0,0 +1,34 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	"github.com/gofrs/uuid"
+	"time"
+)
+
+// how often due reminders of saved messages are looked for
+const reminderInterval = 30 * time.Second
+
+// remind periodically sends the reminders of saved messages that are due
+func remind() {
+	ticker := time.NewTicker(reminderInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		SendReminders(now)
+	}
+}
+
+// SendReminders sends the reminders due at the given time, as system messages to the users that set them
+func SendReminders(now time.Time) {
+	due, err := content.DueReminders(now)
+	if err != nil {
+		return
+	}
+	for _, saved := range due {
+		msg, ok, _ := content.Remind(saved)
+		if ok {
+			publish(Protocol{Type: "msg", ID: msg.ID.String(), Message: &msg}, []uuid.UUID{saved.UserID})
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	"github.com/gofrs/uuid"
+	"log/slog"
+	"sort"
+)
+
+// max number of frames replayed on a resume, leaving room in the send queue for the frames held back
+// meanwhile. Channels that don't fit are left to the client to resync.
+const maxReplay = sendQueueSize / 2
+
+// ack records how far a client has processed a channel stream
+func ack(client *Client, proto Protocol) {
+	if proto.ChannelID == nil || proto.Seq == 0 {
+		slog.Warn("ignoring ack without channel or sequence", slog.String("userID", client.user.ID.String()))
+		return
+	}
+	content.Ack(*proto.ChannelID, client.user.ID, proto.Seq)
+}
+
+// resume replays what a client missed in each of the user's channels since the sequence numbers it
+// last saw, falling back to what the user acked. Live frames are held back until the replay is done,
+// so the client sees every channel stream in order.
+func resume(client *Client, proto Protocol) {
+	userID := client.user.ID
+
+	channelIDs, err := content.UserChannelIDs(userID)
+	if err != nil {
+		return
+	}
+	acks, err := content.LoadAcks(userID)
+	if err != nil {
+		return
+	}
+
+	hub.control(client, opHold)
+	defer hub.control(client, opRelease)
+
+	// the replay is queued all at once, so it has to fit the send queue of the client
+	budget := maxReplay
+	for _, channelID := range channelIDs {
+		seq, ok := proto.Resume[channelID]
+		if !ok {
+			seq, ok = acks[channelID]
+		}
+		if !ok {
+			// nothing known about this channel, the client loads it from scratch
+			continue
+		}
+
+		// one more than fits tells whether the channel is further behind
+		events, err := content.EventsSince(channelID, seq, budget+1)
+		if err != nil {
+			continue
+		}
+		if events.Len() > budget {
+			id := channelID
+			hub.reply(client, Protocol{Type: "resync", ChannelID: &id})
+			continue
+		}
+		for _, frame := range replayFrames(channelID, events) {
+			hub.reply(client, frame)
+		}
+		budget -= events.Len()
+	}
+
+	hub.reply(client, Protocol{Type: "resumed"})
+}
+
+// replayFrames turns the events of a channel into the frames originally sent for them, in stream order
+func replayFrames(channelID uuid.UUID, events content.ChannelEvents) []Protocol {
+	frames := make([]Protocol, 0, events.Len())
+
+	for i := range events.Messages {
+		msg := events.Messages[i]
+		typ := "msg"
+		if msg.DeletedAt != nil {
+			typ = "delete"
+		} else if msg.EditedAt != nil {
+			// the latest version of an edited message; clients that missed the original take it as new
+			typ = "edit"
+		}
+		frames = append(frames, Protocol{Type: typ, ID: msg.ID.String(), ChannelID: &channelID, Seq: msg.Seq, Message: &msg})
+	}
+	for _, v := range events.Reactions {
+		frames = append(frames, Protocol{Type: "react", ChannelID: &channelID, Seq: v.Seq,
+			Like: &Like{UserID: v.UserID, MessageID: v.MessageID, Emoji: v.Emoji, Remove: v.RemovedAt != nil}})
+	}
+	for _, v := range events.Reads {
+		frames = append(frames, Protocol{Type: "read", ChannelID: &channelID, Seq: v.Seq,
+			Read: &Read{UserID: v.UserID, MessageID: v.MessageID}})
+	}
+
+	sort.Slice(frames, func(i, j int) bool { return frames[i].Seq < frames[j].Seq })
+	return frames
+}
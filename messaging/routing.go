@@ -0,0 +1,178 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	"areo/go-chat-backend/users"
+	"errors"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"slices"
+)
+
+var (
+	ErrNoTarget      = errors.New("frame has no target")
+	ErrNotInAudience = errors.New("sender can't see the target of this frame")
+)
+
+// outbound is a frame together with the users it may be delivered to. Frames and operations aimed
+// at a single client, like replaying missed frames, carry the client instead.
+type outbound struct {
+	proto    Protocol
+	audience map[uuid.UUID]bool
+	client   *Client
+	op       clientOp
+}
+
+type clientOp int
+
+const (
+	opDeliver clientOp = iota
+	opHold             // hold back frames for the client while missed frames are replayed
+	opRelease          // deliver the frames held back
+)
+
+func newOutbound(proto Protocol, userIDs []uuid.UUID) outbound {
+	audience := make(map[uuid.UUID]bool, len(userIDs))
+	for _, id := range userIDs {
+		audience[id] = true
+	}
+	return outbound{proto: proto, audience: audience}
+}
+
+// audience works out which users may receive a frame sent by the given user. Channel messages go to
+// the channel participants, direct messages to sender and recipient, and typing, like and read frames
+// to whoever can see the channel or message they refer to.
+func audience(proto Protocol, sender users.User) ([]uuid.UUID, error) {
+	switch proto.Type {
+	case "msg", "edit", "delete":
+		if proto.Message == nil {
+			return nil, ErrNoTarget
+		}
+		ids, err := proto.Message.Audience()
+		if err != nil {
+			return nil, err
+		}
+		// echo to the sender's other sockets, even if not (yet) a participant
+		return append(ids, sender.ID), nil
+	case "typ":
+		if proto.Typ == nil {
+			return nil, ErrNoTarget
+		}
+		ids, _, err := typingAudience(proto.Typ.ID, sender)
+		return ids, err
+	case "react":
+		if proto.Like == nil {
+			return nil, ErrNoTarget
+		}
+		return messageAudience(proto.Like.MessageID, sender)
+	case "read":
+		if proto.Read == nil {
+			return nil, ErrNoTarget
+		}
+		return messageAudience(proto.Read.MessageID, sender)
+	}
+	return nil, ErrNoTarget
+}
+
+// typingAudience resolves the target of a typing frame, which is either a channel, a message being
+// replied to, or the other party of a direct conversation. The channel is returned for channel targets.
+func typingAudience(id uuid.UUID, sender users.User) ([]uuid.UUID, *uuid.UUID, error) {
+	if id == uuid.Nil {
+		return nil, nil, ErrNoTarget
+	}
+
+	ids, err := content.ChannelParticipantIDs(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ids) > 0 {
+		ids, err = visibleAudience(ids, sender)
+		return ids, &id, err
+	}
+
+	ids, err = messageAudience(id, sender)
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return ids, nil, err
+	}
+
+	return []uuid.UUID{sender.ID, id}, nil, nil
+}
+
+// messageAudience returns the users that can see a message, provided the sender is one of them
+func messageAudience(messageID uuid.UUID, sender users.User) ([]uuid.UUID, error) {
+	ids, err := content.MessageAudience(messageID)
+	if err != nil {
+		return nil, err
+	}
+	return visibleAudience(ids, sender)
+}
+
+// visibleAudience only passes on an audience if the sender is part of it, so that frames can't be
+// used to reach into channels or conversations the sender isn't in
+func visibleAudience(ids []uuid.UUID, sender users.User) ([]uuid.UUID, error) {
+	if !slices.Contains(ids, sender.ID) {
+		return nil, ErrNotInAudience
+	}
+	return ids, nil
+}
+
+// relayEvent passes what was done through the REST API on to the users that can see it, as the frame
+// the same action over the web socket would have produced
+func relayEvent(event content.Event) {
+	var proto Protocol
+	var messageID uuid.UUID
+	var seq uint64
+
+	switch {
+	case (event.Type == "pin" || event.Type == "unpin") && event.Pin != nil:
+		// pins aren't part of the channel stream, members just hear about them
+		ids, err := content.ChannelParticipantIDs(event.Pin.ChannelID)
+		if err != nil {
+			return
+		}
+		publish(Protocol{Type: event.Type, ID: event.Pin.ID.String(), ChannelID: &event.Pin.ChannelID, Pin: event.Pin}, ids)
+		return
+	case event.Type == "join_request" && event.Member != nil:
+		// only the moderators answer requests to join
+		ids, err := content.ModeratorIDs(event.Member.ChannelID)
+		if err != nil {
+			return
+		}
+		publish(Protocol{Type: "join_request", ID: event.Member.UserID.String(), ChannelID: &event.Member.ChannelID,
+			Member: event.Member}, ids)
+		return
+	case event.Type == "purge":
+		purgeHuddles(event.ChannelID)
+		return
+	case event.Type == "unread":
+		pushUnread(event.UserID)
+		return
+	case event.Type == "msg" && event.Message != nil:
+		messageID, seq = event.Message.ID, event.Message.Seq
+		proto = Protocol{Type: "msg", ID: messageID.String(), Message: event.Message}
+		defer pushUnread(event.Message.Mentions...)
+	case event.Type == "react" && event.Reaction != nil:
+		messageID, seq = event.Reaction.MessageID, event.Reaction.Seq
+		proto = Protocol{Type: "react", Like: &Like{UserID: event.UserID, MessageID: messageID,
+			Emoji: event.Reaction.Emoji, Remove: event.Reaction.RemovedAt != nil}}
+	case event.Type == "read" && event.Read != nil:
+		messageID, seq = event.Read.MessageID, event.Read.Seq
+		proto = Protocol{Type: "read", Read: &Read{UserID: event.UserID, MessageID: messageID}}
+		defer pushUnread(event.UserID)
+	case event.Type == "delete" && event.Message != nil:
+		messageID, seq = event.Message.ID, event.Message.Seq
+		proto = Protocol{Type: "delete", ID: messageID.String(), Message: event.Message}
+	default:
+		return
+	}
+
+	ids, err := content.MessageAudience(messageID)
+	if err != nil {
+		return
+	}
+	if seq != 0 {
+		proto.ChannelID, _ = content.MessageChannelID(messageID)
+		proto.Seq = seq
+	}
+	publish(proto, ids)
+}
@@ -0,0 +1,242 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/users"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/gofrs/uuid"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a long-poll request waits for frames before returning empty handed
+	pollWait = 25 * time.Second
+
+	// long-poll sessions not polled for this long are dropped
+	pollSessionTTL = 60 * time.Second
+
+	// max number of frames returned by a single long-poll request
+	maxPollFrames = 100
+)
+
+var ErrSessionExpired = errors.New("event session expired, start a new one")
+
+// streamUser authenticates an event stream or long-poll request. The token is taken from the same
+// places as for the web socket, as EventSource can't set an Authorization header.
+func streamUser(r *http.Request) (users.User, error) {
+	token := requestToken(r)
+	if token == "" {
+		return users.User{}, ErrNotAuthenticated
+	}
+	return Authenticate(token)
+}
+
+// Events streams the frames the user would receive on a web socket as server-sent events, for clients
+// that can't get a web socket through. Outbound actions go through the REST endpoints.
+func Events(w http.ResponseWriter, r *http.Request) {
+
+	user, err := streamUser(r)
+	if err != nil {
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, render.M{"status": "error", "err": "streaming not supported"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+
+	client := newClient(hub, nil, user)
+	hub.register <- client
+	presence.connected(client)
+	defer client.disconnect()
+
+	// confirm authentication, like on the web socket
+	data, _ := json.Marshal(Protocol{V: ProtocolVersion, Type: "auth", ID: user.ID.String()})
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	flusher.Flush()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data, ok := <-client.send:
+			if !ok {
+				// the hub dropped us for being too slow
+				fmt.Fprint(w, "event: close\ndata: evicted\n\n")
+				flusher.Flush()
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-ticker.C:
+			// comments keep proxies from timing out an idle stream
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// pollSession is a client kept registered with the hub between long-poll requests
+type pollSession struct {
+	client   *Client
+	lastPoll time.Time
+	polling  bool
+	pending  []json.RawMessage // frames taken off the queue for a request the client gave up on
+}
+
+type pollSessions struct {
+	mu       sync.Mutex
+	sessions map[uuid.UUID]*pollSession
+}
+
+var polls = pollSessions{sessions: make(map[uuid.UUID]*pollSession)}
+
+// PollEvents is the long-poll variant of Events. The first request, without a session, registers a
+// session and returns its id; later requests pass it and get the frames queued since, waiting for up
+// to 25 seconds when there are none.
+func PollEvents(w http.ResponseWriter, r *http.Request) {
+
+	user, err := streamUser(r)
+	if err != nil {
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	if r.URL.Query().Get("session") == "" {
+		id, _ := uuid.NewV4()
+		client := newClient(hub, nil, user)
+		hub.register <- client
+		presence.connected(client)
+
+		polls.mu.Lock()
+		polls.sessions[id] = &pollSession{client: client, lastPoll: time.Now()}
+		polls.mu.Unlock()
+
+		render.JSON(w, r, render.M{"session": id, "frames": []Protocol{{V: ProtocolVersion, Type: "auth", ID: user.ID.String()}}})
+		return
+	}
+
+	id, err := uuid.FromString(r.URL.Query().Get("session"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"status": "error", "err": err.Error()})
+		return
+	}
+
+	polls.mu.Lock()
+	session := polls.sessions[id]
+	if session == nil || session.client.user.ID != user.ID {
+		polls.mu.Unlock()
+		render.Status(r, http.StatusGone)
+		render.JSON(w, r, render.M{"status": "error", "err": ErrSessionExpired.Error()})
+		return
+	}
+	if session.polling {
+		polls.mu.Unlock()
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, render.M{"status": "error", "err": "session is already being polled"})
+		return
+	}
+	session.polling = true
+	polls.mu.Unlock()
+
+	frames, open := session.wait(r)
+
+	polls.mu.Lock()
+	if r.Context().Err() != nil {
+		// nobody is there to receive the frames, so they go out with the next poll
+		session.pending = frames
+	}
+	session.polling = false
+	session.lastPoll = time.Now()
+	if !open {
+		delete(polls.sessions, id)
+	}
+	polls.mu.Unlock()
+
+	if !open {
+		// the hub dropped the session for being too slow
+		session.client.disconnect()
+		render.Status(r, http.StatusGone)
+		render.JSON(w, r, render.M{"status": "error", "err": ErrSessionExpired.Error()})
+		return
+	}
+	render.JSON(w, r, render.M{"session": id, "frames": frames})
+}
+
+// wait collects the frames kept from an earlier request and those queued for a session, waiting for
+// the first one if there are none yet. Returns false once the hub has closed the queue.
+func (s *pollSession) wait(r *http.Request) (frames []json.RawMessage, open bool) {
+	frames = append([]json.RawMessage{}, s.pending...)
+	s.pending = nil
+
+	if len(frames) == 0 {
+		timeout := time.NewTimer(pollWait)
+		defer timeout.Stop()
+
+		select {
+		case data, ok := <-s.client.send:
+			if !ok {
+				return frames, false
+			}
+			frames = append(frames, data)
+		case <-timeout.C:
+			return frames, true
+		case <-r.Context().Done():
+			return frames, true
+		}
+	}
+
+	for len(frames) < maxPollFrames {
+		select {
+		case data, ok := <-s.client.send:
+			if !ok {
+				return frames, false
+			}
+			frames = append(frames, data)
+		default:
+			return frames, true
+		}
+	}
+	return frames, true
+}
+
+// expire drops long-poll sessions whose clients stopped polling
+func (p *pollSessions) expire() {
+	ticker := time.NewTicker(pollSessionTTL / 2)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var expired []*Client
+		p.mu.Lock()
+		for id, session := range p.sessions {
+			if !session.polling && now.Sub(session.lastPoll) > pollSessionTTL {
+				expired = append(expired, session.client)
+				delete(p.sessions, id)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, client := range expired {
+			slog.Debug("dropping idle long-poll session", slog.String("userID", client.user.ID.String()))
+			client.disconnect()
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	"github.com/gofrs/uuid"
+	"slices"
+)
+
+// notifyThread tells the followers of a thread about a new reply with a thread frame, on top of the msg
+// frame everyone in the channel gets. The author of the reply isn't told, nor are followers who can no
+// longer see the thread.
+func notifyThread(reply content.Message) {
+	followers, err := content.ThreadFollowerIDs(*reply.InReplyToID)
+	if err != nil {
+		return
+	}
+	audience, err := reply.Audience()
+	if err != nil {
+		return
+	}
+
+	ids := make([]uuid.UUID, 0, len(followers))
+	for _, id := range followers {
+		if id != reply.UserID && slices.Contains(audience, id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		publish(Protocol{Type: "thread", ID: reply.InReplyToID.String(), ChannelID: reply.ChannelID, Message: &reply}, ids)
+	}
+}
@@ -0,0 +1,84 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/users"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"github.com/go-chi/render"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default lifetime of TURN credentials, long enough for a call to outlast the allocation refreshes
+const defaultTurnTTL = 12 * time.Hour
+
+// ICEServer is a STUN or TURN server in the shape RTCPeerConnection expects it
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// turnCredentials computes time limited credentials in the coturn REST API scheme; the username is the
+// expiry timestamp and user id, and the password the base64 encoded HMAC-SHA1 of the username, keyed
+// with the secret shared with the TURN servers (static-auth-secret in coturn)
+func turnCredentials(secret string, userID string, expiresAt time.Time) (username string, credential string) {
+	username = strconv.FormatInt(expiresAt.Unix(), 10) + ":" + userID
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// splitURLs splits a comma separated list of server urls
+func splitURLs(list string) (urls []string) {
+	for _, v := range strings.Split(list, ",") {
+		if strings.TrimSpace(v) != "" {
+			urls = append(urls, strings.TrimSpace(v))
+		}
+	}
+	return
+}
+
+// GetICEServers returns the STUN and TURN servers to use for calls, configured with STUN_URLS and
+// TURN_URLS, along with TURN credentials derived from TURN_SECRET that expire after TURN_TTL seconds
+func GetICEServers(w http.ResponseWriter, r *http.Request) {
+
+	user := r.Context().Value("loggedInUser").(users.User)
+
+	ttl := defaultTurnTTL
+	if v := os.Getenv("TURN_TTL"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			slog.Warn("ignoring invalid TURN_TTL", slog.String("ttl", v))
+		} else {
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+
+	var servers []ICEServer
+	if stun := splitURLs(os.Getenv("STUN_URLS")); len(stun) > 0 {
+		servers = append(servers, ICEServer{URLs: stun})
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	if turn := splitURLs(os.Getenv("TURN_URLS")); len(turn) > 0 {
+		if secret := os.Getenv("TURN_SECRET"); secret != "" {
+			username, credential := turnCredentials(secret, user.ID.String(), expiresAt)
+			servers = append(servers, ICEServer{URLs: turn, Username: username, Credential: credential})
+		} else {
+			slog.Warn("leaving out TURN servers, TURN_SECRET isn't set")
+		}
+	}
+
+	if len(servers) == 0 {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, render.M{"status": "error", "err": "no ICE servers configured"})
+		return
+	}
+	render.JSON(w, r, render.M{"iceServers": servers, "ttl": int(ttl.Seconds()), "expiresAt": expiresAt})
+}
@@ -0,0 +1,14 @@
+package messaging
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTurnCredentials(t *testing.T) {
+	username, credential := turnCredentials("north", "0d4b7e2a-7c1e-4f3a-9c2b-1f2e3d4c5b6a", time.Unix(1700000000, 0))
+
+	assert.Equal(t, "1700000000:0d4b7e2a-7c1e-4f3a-9c2b-1f2e3d4c5b6a", username)
+	assert.Equal(t, "WJvLXXfDnKs5Ug2hdMx6gNkjH88=", credential, "credential should match what coturn computes")
+}
@@ -0,0 +1,117 @@
+package messaging
+
+import (
+	"github.com/gofrs/uuid"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// typing frames from a user for the same target are passed on at most this often
+	typingThrottle = 3 * time.Second
+
+	// a typing indicator not refreshed for this long is stopped by the server
+	typingTimeout = 6 * time.Second
+)
+
+type typingKey struct {
+	userID   uuid.UUID
+	targetID uuid.UUID
+}
+
+// typingState is an active typing indicator, along with who was told about it
+type typingState struct {
+	forwarded time.Time
+	audience  []uuid.UUID
+	channelID *uuid.UUID
+	timer     *time.Timer
+	email     string
+}
+
+// typingTracker throttles typing frames and stops indicators that clients fail to stop themselves,
+// e.g. because the app was killed mid sentence
+type typingTracker struct {
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+}
+
+var typing = newTypingTracker()
+
+func newTypingTracker() *typingTracker {
+	return &typingTracker{active: make(map[typingKey]*typingState)}
+}
+
+// typed handles a typing frame from a client, starting, refreshing or stopping the indicator
+func (t *typingTracker) typed(client *Client, typ *Typing) {
+	key := typingKey{userID: client.user.ID, targetID: typ.ID}
+
+	t.mu.Lock()
+	state := t.active[key]
+	if typ.Stop {
+		if state != nil {
+			t.stop(key, state)
+		}
+		t.mu.Unlock()
+		return
+	}
+	if state != nil && time.Since(state.forwarded) < typingThrottle {
+		state.timer.Reset(typingTimeout)
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+
+	ids, channelID, err := typingAudience(typ.ID, client.user)
+	if err != nil {
+		slog.Warn("dropping typing frame without audience", slog.String("userID", client.user.ID.String()), slog.Any("err", err))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state = t.active[key]
+	if state == nil {
+		state = &typingState{audience: ids, channelID: channelID, email: client.user.Email}
+		state.timer = time.AfterFunc(typingTimeout, func() { t.expire(key, state) })
+		t.active[key] = state
+	} else {
+		state.timer.Reset(typingTimeout)
+	}
+	state.forwarded = time.Now()
+
+	expiresAt := state.forwarded.Add(typingTimeout)
+	publish(Protocol{Type: "typ", ChannelID: channelID, Typ: &Typing{Email: client.user.Email, UserID: client.user.ID,
+		ID: typ.ID, ExpiresAt: &expiresAt}}, ids)
+}
+
+// expire stops an indicator that wasn't refreshed in time
+func (t *typingTracker) expire(key typingKey, state *typingState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.active[key] == state {
+		t.stop(key, state)
+	}
+}
+
+// stop removes an indicator and tells its audience. Must be called with the lock held.
+func (t *typingTracker) stop(key typingKey, state *typingState) {
+	state.timer.Stop()
+	delete(t.active, key)
+	publish(Protocol{Type: "typ", ChannelID: state.channelID, Typ: &Typing{Email: state.email, UserID: key.userID,
+		ID: key.targetID, Stop: true}}, state.audience)
+}
+
+// disconnected stops the indicators of a user once their last socket has gone
+func (t *typingTracker) disconnected(userID uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, state := range t.active {
+		if key.userID == userID {
+			t.stop(key, state)
+		}
+	}
+}
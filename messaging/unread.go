@@ -0,0 +1,27 @@
+package messaging
+
+import (
+	"areo/go-chat-backend/content"
+	"github.com/gofrs/uuid"
+)
+
+// pushUnread sends users their unread summary, after they read something or got mentioned
+func pushUnread(userIDs ...uuid.UUID) {
+	for _, id := range userIDs {
+		summary, err := content.UserUnread(id)
+		if err != nil {
+			continue
+		}
+		publish(Protocol{Type: "unread", Unread: &summary}, []uuid.UUID{id})
+	}
+}
+
+// replyUnread answers a client asking for the unread summary of its user
+func replyUnread(client *Client, proto Protocol) {
+	summary, err := content.UserUnread(client.user.ID)
+	if err != nil {
+		fail(client, proto, &ProtocolError{Code: ErrCodeInternal, Message: "unable to count unread messages"})
+		return
+	}
+	hub.reply(client, Protocol{Type: "unread", Ref: proto.Ref, Unread: &summary})
+}
@@ -0,0 +1,1642 @@
+package main
+
+import (
+	"areo/go-chat-backend/content"
+	"areo/go-chat-backend/messaging"
+	"areo/go-chat-backend/server"
+	"areo/go-chat-backend/users"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dial the web socket endpoint of a test server, optionally passing a bearer token in the handshake
+func dialWebSocket(server *httptest.Server, token string) (*websocket.Conn, *http.Response, error) {
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	if token != "" {
+		wsURL += "?access_token=" + url.QueryEscape(strings.TrimPrefix(token, "Bearer "))
+	}
+	return websocket.DefaultDialer.Dial(wsURL, nil)
+}
+
+func TestWebSocketAuth(t *testing.T) {
+
+	if os.Getenv("CLIENT_ID") == "" || os.Getenv("CLIENT_SECRET") == "" {
+		t.Skip("need to run web socket tests with CLIENT_ID & CLIENT_SECRET specified in environment")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	oauthToken, err := OAUTHsignin(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"))
+	assert.NoError(t, err, "unable to authenticate")
+
+	t.Run("handshake with invalid token is rejected", func(t *testing.T) {
+		_, resp, err := dialWebSocket(server, "Bearer XXX")
+		assert.Error(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	t.Run("handshake with valid token is bound to user", func(t *testing.T) {
+		ws, _, err := dialWebSocket(server, oauthToken)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer ws.Close()
+
+		var proto messaging.Protocol
+		assert.NoError(t, ws.ReadJSON(&proto))
+		assert.Equal(t, "auth", proto.Type)
+		assert.NotEmpty(t, proto.ID)
+	})
+
+	t.Run("auth frame with valid token is accepted", func(t *testing.T) {
+		ws, _, err := dialWebSocket(server, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer ws.Close()
+
+		assert.NoError(t, ws.WriteJSON(messaging.Protocol{Type: "auth", Token: oauthToken}))
+
+		var proto messaging.Protocol
+		assert.NoError(t, ws.ReadJSON(&proto))
+		assert.Equal(t, "auth", proto.Type)
+	})
+
+	t.Run("unauthenticated socket is closed", func(t *testing.T) {
+		ws, _, err := dialWebSocket(server, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer ws.Close()
+
+		assert.NoError(t, ws.WriteJSON(messaging.Protocol{Type: "msg"}))
+
+		var proto messaging.Protocol
+		err = ws.ReadJSON(&proto)
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "expected policy violation, got %v", err)
+	})
+}
+
+func TestProtocolValidation(t *testing.T) {
+
+	if os.Getenv("CLIENT_ID") == "" || os.Getenv("CLIENT_SECRET") == "" {
+		t.Skip("need to run protocol tests with CLIENT_ID & CLIENT_SECRET specified in environment")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	oauthToken, err := OAUTHsignin(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"))
+	assert.NoError(t, err, "unable to authenticate")
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?access_token=" +
+		url.QueryEscape(strings.TrimPrefix(oauthToken, "Bearer "))
+
+	t.Run("unsupported version is rejected", func(t *testing.T) {
+		dialer := websocket.Dialer{Subprotocols: []string{"chat.v99"}}
+		_, resp, err := dialer.Dial(wsURL, nil)
+		assert.Error(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v1"}}
+	ws, resp, err := dialer.Dial(wsURL, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+	assert.Equal(t, "chat.v1", resp.Header.Get("Sec-WebSocket-Protocol"))
+	auth := readFrame(t, ws, "auth")
+	assert.Equal(t, messaging.ProtocolVersion, auth.V)
+
+	t.Run("malformed frame gets a correlated error", func(t *testing.T) {
+		assert.NoError(t, ws.WriteJSON(messaging.Protocol{Type: "react", Ref: "r1"}))
+		failed := readFrame(t, ws, "error")
+		assert.Equal(t, "r1", failed.Ref)
+		if assert.NotNil(t, failed.Error) {
+			assert.Equal(t, messaging.ErrCodeMissingPayload, failed.Error.Code)
+		}
+	})
+
+	t.Run("undecodable frame gets an error without hanging up", func(t *testing.T) {
+		assert.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"msg","ref":"r2","seq":"x"}`)))
+		failed := readFrame(t, ws, "error")
+		assert.Equal(t, "r2", failed.Ref)
+		if assert.NotNil(t, failed.Error) {
+			assert.Equal(t, messaging.ErrCodeInvalidFrame, failed.Error.Code)
+		}
+	})
+}
+
+func TestPresence(t *testing.T) {
+
+	if os.Getenv("CLIENT_ID") == "" || os.Getenv("CLIENT_SECRET") == "" {
+		t.Skip("need to run presence tests with CLIENT_ID & CLIENT_SECRET specified in environment")
+	}
+	// a user no other test connects, as sockets left open by earlier runs keep their users online for a while
+	if TestUsers[2].ID == uuid.Nil {
+		t.Skip("presence tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	oauthToken, err := OAUTHsignin(TestUsers[2].Email, TestUsers[2].Password)
+	assert.NoError(t, err, "unable to authenticate")
+
+	lookup := func(userID string) (presence messaging.Presence) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/users/presence?ids="+userID, nil)
+		req.Header.Set("Authorization", oauthToken)
+		router.ServeHTTP(w, req)
+
+		var resp struct {
+			Items []messaging.Presence `json:"items"`
+		}
+		assert.Equal(t, 200, w.Code)
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		if len(resp.Items) == 1 {
+			presence = resp.Items[0]
+		}
+		return
+	}
+
+	ws, _, err := dialWebSocket(server, oauthToken)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var proto messaging.Protocol
+	assert.NoError(t, ws.ReadJSON(&proto))
+	userID := proto.ID
+
+	assert.Eventually(t, func() bool {
+		return lookup(userID).Status == messaging.PresenceOnline
+	}, 2*time.Second, 20*time.Millisecond, "user should be online while connected")
+
+	// users without a channel in common stay out of sight
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/users/presence?ids="+uuid.Must(uuid.NewV4()).String(), nil)
+	req.Header.Set("Authorization", oauthToken)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+
+	ws.Close()
+
+	assert.Eventually(t, func() bool {
+		presence := lookup(userID)
+		return presence.Status == messaging.PresenceOffline && presence.LastSeen != nil
+	}, 2*time.Second, 20*time.Millisecond, "user should be offline with last seen after disconnecting")
+
+	// last seen is only shared through presence lookups, not with the rest of the profile
+	w = apiRequest(t, "GET", TestUsers[2].Email, TestUsers[2].Password, "/users/"+userID, nil)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "lastSeen")
+}
+
+func TestTyping(t *testing.T) {
+
+	if os.Getenv("CLIENT_ID") == "" || os.Getenv("CLIENT_SECRET") == "" {
+		t.Skip("need to run typing tests with CLIENT_ID & CLIENT_SECRET specified in environment")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	oauthToken, err := OAUTHsignin(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"))
+	assert.NoError(t, err, "unable to authenticate")
+
+	ws, _, err := dialWebSocket(server, oauthToken)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+
+	var proto messaging.Protocol
+	assert.NoError(t, ws.ReadJSON(&proto))
+
+	// typing in a direct conversation is echoed to the sender's own sockets
+	recipientID, _ := uuid.NewV4()
+	typing := messaging.Protocol{Type: "typ", Typ: &messaging.Typing{ID: recipientID}}
+	assert.NoError(t, ws.WriteJSON(typing))
+	assert.NoError(t, ws.WriteJSON(typing))
+	typing.Typ.Stop = true
+	assert.NoError(t, ws.WriteJSON(typing))
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var frames []messaging.Protocol
+	for len(frames) < 2 {
+		var frame messaging.Protocol
+		if !assert.NoError(t, ws.ReadJSON(&frame)) {
+			return
+		}
+		if frame.Type == "typ" {
+			frames = append(frames, frame)
+		}
+	}
+
+	assert.False(t, frames[0].Typ.Stop, "first frame should start the indicator")
+	assert.NotNil(t, frames[0].Typ.ExpiresAt, "indicator should carry its expiry")
+	assert.True(t, frames[1].Typ.Stop, "repeated typing should be throttled, leaving only the stop frame")
+}
+
+// read frames from a web socket until one of the given type arrives
+func readFrame(t *testing.T, ws *websocket.Conn, frameType string) (proto messaging.Protocol) {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		proto = messaging.Protocol{}
+		if !assert.NoError(t, ws.ReadJSON(&proto), "expected %s frame", frameType) || proto.Type == frameType {
+			return
+		}
+	}
+}
+
+// sign in and connect a web socket, waiting for the authentication to be confirmed
+func connectWebSocket(t *testing.T, server *httptest.Server, id, secret string) *websocket.Conn {
+	oauthToken, err := OAUTHsignin(id, secret)
+	assert.NoError(t, err, "unable to authenticate")
+	ws, _, err := dialWebSocket(server, oauthToken)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	readFrame(t, ws, "auth")
+	return ws
+}
+
+func TestCallSignaling(t *testing.T) {
+
+	if os.Getenv("CLIENT_ID") == "" || os.Getenv("CLIENT_SECRET") == "" {
+		t.Skip("need to run call tests with CLIENT_ID & CLIENT_SECRET specified in environment")
+	}
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil {
+		t.Skip("call tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	caller := connectWebSocket(t, server, TestUsers[0].Email, TestUsers[0].Password)
+	defer caller.Close()
+	callee := connectWebSocket(t, server, TestUsers[1].Email, TestUsers[1].Password)
+	defer callee.Close()
+	bystander := connectWebSocket(t, server, os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"))
+	defer bystander.Close()
+
+	assert.NoError(t, caller.WriteJSON(messaging.Protocol{Type: "call",
+		Call: &messaging.Call{RecipientID: TestUsers[1].ID.String(), Connection: "offer"}}))
+
+	offer := readFrame(t, callee, "call")
+	if !assert.NotNil(t, offer.Call) {
+		return
+	}
+	assert.Equal(t, "offer", offer.Call.Connection)
+	assert.Equal(t, messaging.CallRinging, offer.Call.State)
+	assert.Equal(t, TestUsers[0].ID, offer.Call.UserID)
+
+	assert.NoError(t, callee.WriteJSON(messaging.Protocol{Type: "answer",
+		Call: &messaging.Call{ID: offer.Call.ID, Connection: "answer"}}))
+	answer := readFrame(t, caller, "answer")
+	assert.Equal(t, "answer", answer.Call.Connection)
+
+	assert.NoError(t, caller.WriteJSON(messaging.Protocol{Type: "hangup", Call: &messaging.Call{ID: offer.Call.ID}}))
+	for _, ws := range []*websocket.Conn{caller, callee} {
+		history := readFrame(t, ws, "msg")
+		if assert.NotNil(t, history.Message) {
+			assert.Equal(t, "system", history.Message.MessageType)
+			assert.Equal(t, "call_ended", history.Message.SystemFlags)
+		}
+	}
+
+	// signaling never reaches users outside the call
+	bystander.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		var proto messaging.Protocol
+		if bystander.ReadJSON(&proto) != nil {
+			break
+		}
+		assert.NotContains(t, []string{"call", "answer", "callstate"}, proto.Type, "bystander received call frame")
+	}
+
+	// signaling that doesn't fit the call is answered with an error; the bystander socket timed out above
+	outsider := connectWebSocket(t, server, os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"))
+	defer outsider.Close()
+	unknownID, _ := uuid.NewV4()
+	for _, c := range []struct {
+		ws    *websocket.Conn
+		proto messaging.Protocol
+		code  string
+	}{
+		{callee, messaging.Protocol{Type: "answer", Ref: "a1", Call: &messaging.Call{ID: unknownID, Connection: "answer"}}, messaging.ErrCodeInvalidField},
+		{outsider, messaging.Protocol{Type: "hangup", Ref: "h1", Call: &messaging.Call{ID: offer.Call.ID}}, messaging.ErrCodeNotAllowed},
+		{caller, messaging.Protocol{Type: "hangup", Ref: "h2", Call: &messaging.Call{ID: offer.Call.ID}}, messaging.ErrCodeNotAllowed},
+	} {
+		assert.NoError(t, c.ws.WriteJSON(c.proto))
+		failed := readFrame(t, c.ws, "error")
+		if assert.NotNil(t, failed.Error, c.proto.Ref) {
+			assert.Equal(t, c.proto.Ref, failed.Ref)
+			assert.Equal(t, c.code, failed.Error.Code)
+		}
+	}
+}
+
+func TestHuddle(t *testing.T) {
+
+	if os.Getenv("CLIENT_ID") == "" || os.Getenv("CLIENT_SECRET") == "" {
+		t.Skip("need to run huddle tests with CLIENT_ID & CLIENT_SECRET specified in environment")
+	}
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil {
+		t.Skip("huddle tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// the first user sets up a channel the second user joins
+	post := func(id, secret, path string, body any) *httptest.ResponseRecorder {
+		oauthToken, err := OAUTHsignin(id, secret)
+		assert.NoError(t, err, "unable to authenticate")
+		jsonValue, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1"+path, bytes.NewBuffer(jsonValue))
+		req.Header.Set("Authorization", oauthToken)
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w := post(TestUsers[0].Email, TestUsers[0].Password, "/channels/new", content.Channel{Title: "huddle channel", Open: true})
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	w = post(TestUsers[1].Email, TestUsers[1].Password, "/channels/"+channel.ID.String()+"/subscribe", map[string]bool{"subscribe": true})
+	assert.Equal(t, 200, w.Code)
+
+	first := connectWebSocket(t, server, TestUsers[0].Email, TestUsers[0].Password)
+	defer first.Close()
+	second := connectWebSocket(t, server, TestUsers[1].Email, TestUsers[1].Password)
+	defer second.Close()
+	bystander := connectWebSocket(t, server, os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"))
+	defer bystander.Close()
+
+	assert.NoError(t, first.WriteJSON(messaging.Protocol{Type: "join", ChannelID: &channel.ID}))
+	started := readFrame(t, second, "msg")
+	if assert.NotNil(t, started.Message) {
+		assert.Equal(t, "huddle_started", started.Message.SystemFlags)
+	}
+
+	assert.NoError(t, second.WriteJSON(messaging.Protocol{Type: "join", ChannelID: &channel.ID}))
+	assert.NoError(t, bystander.WriteJSON(messaging.Protocol{Type: "join", Ref: "j1", ChannelID: &channel.ID}))
+	assert.Eventually(t, func() bool {
+		huddle := readFrame(t, first, "huddle")
+		return huddle.Huddle != nil && len(huddle.Huddle.Members) == 2
+	}, 2*time.Second, time.Millisecond, "both channel participants should be in the huddle")
+
+	// mesh signaling is relayed between participants
+	assert.NoError(t, first.WriteJSON(messaging.Protocol{Type: "call", ChannelID: &channel.ID,
+		Call: &messaging.Call{RecipientID: TestUsers[1].ID.String(), Connection: "offer"}}))
+	offer := readFrame(t, second, "call")
+	if assert.NotNil(t, offer.Call) {
+		assert.Equal(t, "offer", offer.Call.Connection)
+		assert.Equal(t, TestUsers[0].ID, offer.Call.UserID)
+	}
+
+	// those outside the huddle are told they can't join or signal it
+	assert.NoError(t, bystander.WriteJSON(messaging.Protocol{Type: "call", Ref: "c1", ChannelID: &channel.ID,
+		Call: &messaging.Call{RecipientID: TestUsers[0].ID.String(), Connection: "offer"}}))
+	for _, ref := range []string{"j1", "c1"} {
+		failed := readFrame(t, bystander, "error")
+		assert.Equal(t, ref, failed.Ref)
+		if assert.NotNil(t, failed.Error) {
+			assert.Equal(t, messaging.ErrCodeNotAllowed, failed.Error.Code)
+		}
+	}
+
+	assert.NoError(t, first.WriteJSON(messaging.Protocol{Type: "leave", ChannelID: &channel.ID}))
+	assert.NoError(t, second.WriteJSON(messaging.Protocol{Type: "leave", ChannelID: &channel.ID}))
+	ended := readFrame(t, first, "msg")
+	for ended.Message != nil && ended.Message.SystemFlags != "huddle_ended" {
+		ended = readFrame(t, first, "msg")
+	}
+	if assert.NotNil(t, ended.Message) {
+		assert.Equal(t, TestUsers[0].ID.String()+","+TestUsers[1].ID.String(), ended.Message.Message,
+			"huddle record should list its participants")
+	}
+}
+
+func TestMessageAuthorization(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil {
+		t.Skip("message authorization tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	post := func(id, secret, path string, body any) *httptest.ResponseRecorder {
+		oauthToken, err := OAUTHsignin(id, secret)
+		assert.NoError(t, err, "unable to authenticate")
+		jsonValue, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1"+path, bytes.NewBuffer(jsonValue))
+		req.Header.Set("Authorization", oauthToken)
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w := post(TestUsers[0].Email, TestUsers[0].Password, "/channels/new", content.Channel{Title: "closed channel"})
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+
+	author := connectWebSocket(t, server, TestUsers[0].Email, TestUsers[0].Password)
+	defer author.Close()
+	other := connectWebSocket(t, server, TestUsers[1].Email, TestUsers[1].Password)
+	defer other.Close()
+
+	t.Run("outsiders can't post in a closed channel", func(t *testing.T) {
+		assert.NoError(t, other.WriteJSON(messaging.Protocol{Type: "msg", Ref: "m1",
+			Message: &content.Message{ChannelID: &channel.ID, Message: "let me in"}}))
+		failed := readFrame(t, other, "error")
+		assert.Equal(t, "m1", failed.Ref)
+		if assert.NotNil(t, failed.Error) {
+			assert.Equal(t, messaging.ErrCodeNotAllowed, failed.Error.Code)
+		}
+	})
+
+	t.Run("messages need somewhere to go", func(t *testing.T) {
+		_, err := content.SaveMessage(TestUsers[0], content.Message{Message: "into the void"})
+		assert.ErrorIs(t, err, content.ErrNoTarget)
+	})
+
+	var posted messaging.Protocol
+	t.Run("the author is the sender", func(t *testing.T) {
+		past := time.Now().Add(-time.Hour)
+		msg := content.Message{ChannelID: &channel.ID, UserID: TestUsers[1].ID, Message: "hello",
+			MessageType: "system", ReplyCount: 42, DeletedByID: &TestUsers[1].ID, EditedAt: &past}
+		msg.CreatedAt, msg.DeletedAt = past, &past
+		assert.NoError(t, author.WriteJSON(messaging.Protocol{Type: "msg", Message: &msg}))
+		posted = readFrame(t, author, "msg")
+		if assert.NotNil(t, posted.Message) {
+			assert.Equal(t, TestUsers[0].ID, posted.Message.UserID, "the user id sent by the client should be ignored")
+			assert.Equal(t, "post", posted.Message.MessageType, "only the server posts system messages")
+			assert.Zero(t, posted.Message.ReplyCount)
+			assert.Nil(t, posted.Message.DeletedAt)
+			assert.Nil(t, posted.Message.DeletedByID)
+			assert.Nil(t, posted.Message.EditedAt)
+			assert.True(t, posted.Message.CreatedAt.After(past))
+		}
+	})
+	if posted.Message == nil {
+		return
+	}
+
+	t.Run("outsiders can't read messages they can't see", func(t *testing.T) {
+		assert.NoError(t, other.WriteJSON(messaging.Protocol{Type: "read", Ref: "r1", Read: &messaging.Read{MessageID: posted.Message.ID}}))
+		failed := readFrame(t, other, "error")
+		assert.Equal(t, "r1", failed.Ref)
+		if assert.NotNil(t, failed.Error) {
+			assert.Equal(t, messaging.ErrCodeNotAllowed, failed.Error.Code)
+		}
+		w := post(TestUsers[1].Email, TestUsers[1].Password, "/messages/"+posted.Message.ID.String()+"/read", nil)
+		assert.Equal(t, 403, w.Code)
+		w = post(TestUsers[1].Email, TestUsers[1].Password, "/channels/"+channel.ID.String()+"/read", nil)
+		assert.Equal(t, 403, w.Code)
+	})
+
+	t.Run("only the author can edit", func(t *testing.T) {
+		w := post(TestUsers[0].Email, TestUsers[0].Password, "/channels/"+channel.ID.String()+"/subscribe",
+			map[string]any{"subscribe": true, "userId": TestUsers[1].ID})
+		assert.Equal(t, 200, w.Code)
+
+		edit := *posted.Message
+		edit.Message = "hijacked"
+		assert.NoError(t, other.WriteJSON(messaging.Protocol{Type: "msg", Ref: "m2", Message: &edit}))
+		failed := readFrame(t, other, "error")
+		assert.Equal(t, "m2", failed.Ref)
+		if assert.NotNil(t, failed.Error) {
+			assert.Equal(t, messaging.ErrCodeNotAllowed, failed.Error.Code)
+		}
+
+		edit.Message, edit.Title, edit.ExternalURL, edit.MessageType = "hello again", "greeting", "https://areo.no", "reply"
+		assert.NoError(t, author.WriteJSON(messaging.Protocol{Type: "msg", Message: &edit}))
+		edited := readFrame(t, other, "edit")
+		if assert.NotNil(t, edited.Message) {
+			assert.Equal(t, "hello again", edited.Message.Message)
+			assert.Equal(t, "greeting", edited.Message.Title)
+			assert.Equal(t, "post", edited.Message.MessageType, "edits keep the kind of message")
+			assert.NotNil(t, edited.Message.EditedAt)
+			assert.Greater(t, edited.Seq, posted.Seq, "edits should move the message along the channel stream")
+		}
+	})
+
+	t.Run("edits keep revisions", func(t *testing.T) {
+		edit := *posted.Message
+		edit.Message, edit.Title, edit.ExternalURL = "goodbye", "", ""
+		assert.NoError(t, author.WriteJSON(messaging.Protocol{Type: "msg", Message: &edit}))
+		readFrame(t, other, "edit")
+
+		// cleared fields are stored cleared
+		w := apiRequest(t, "GET", TestUsers[1].Email, TestUsers[1].Password, "/message/"+posted.Message.ID.String(), nil)
+		assert.Equal(t, 200, w.Code)
+		var stored content.Message
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&stored))
+		assert.Equal(t, "goodbye", stored.Message)
+		assert.Empty(t, stored.Title)
+		assert.Empty(t, stored.ExternalURL)
+		assert.NotNil(t, stored.EditedAt)
+
+		oauthToken, err := OAUTHsignin(TestUsers[1].Email, TestUsers[1].Password)
+		assert.NoError(t, err, "unable to authenticate")
+		w = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/messages/"+posted.Message.ID.String()+"/revisions", nil)
+		req.Header.Set("Authorization", oauthToken)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		var revisions []content.MessageRevision
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&revisions))
+		if assert.Len(t, revisions, 2) {
+			assert.Equal(t, "hello", revisions[0].Message)
+			assert.Equal(t, TestUsers[0].ID, revisions[0].EditorID)
+			assert.Equal(t, "greeting", revisions[1].Title)
+			assert.Equal(t, "https://areo.no", revisions[1].ExternalURL)
+		}
+	})
+
+	t.Run("moderators remove messages, leaving a tombstone", func(t *testing.T) {
+		assert.NoError(t, other.WriteJSON(messaging.Protocol{Type: "msg",
+			Message: &content.Message{ChannelID: &channel.ID, Message: "spam"}}))
+		spam := readFrame(t, other, "msg")
+		if !assert.NotNil(t, spam.Message) {
+			return
+		}
+
+		remove := content.Message{DeleteReason: "spam"}
+		remove.ID = spam.Message.ID
+		assert.NoError(t, author.WriteJSON(messaging.Protocol{Type: "delete", Message: &remove}))
+		deleted := readFrame(t, other, "delete")
+		if assert.NotNil(t, deleted.Message) {
+			assert.Equal(t, spam.Message.ID, deleted.Message.ID)
+			assert.Empty(t, deleted.Message.Message, "tombstones should lose their content")
+			assert.NotNil(t, deleted.Message.DeletedAt)
+			assert.Equal(t, &TestUsers[0].ID, deleted.Message.DeletedByID)
+			assert.Equal(t, "spam", deleted.Message.DeleteReason)
+		}
+	})
+
+	t.Run("only the author or a moderator can delete", func(t *testing.T) {
+		del := func(id, secret string) int {
+			oauthToken, err := OAUTHsignin(id, secret)
+			assert.NoError(t, err, "unable to authenticate")
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("DELETE", "/api/v1/messages/"+posted.Message.ID.String(), nil)
+			req.Header.Set("Authorization", oauthToken)
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+		assert.Equal(t, http.StatusForbidden, del(TestUsers[1].Email, TestUsers[1].Password))
+		assert.Equal(t, http.StatusOK, del(TestUsers[0].Email, TestUsers[0].Password))
+		deleted := readFrame(t, other, "delete")
+		if assert.NotNil(t, deleted.Message) {
+			assert.Equal(t, posted.Message.ID, deleted.Message.ID)
+		}
+	})
+}
+
+// apiRequest calls the REST API as the given user, with an optional JSON body
+func apiRequest(t *testing.T, method, id, secret, path string, body any) *httptest.ResponseRecorder {
+	oauthToken, err := OAUTHsignin(id, secret)
+	assert.NoError(t, err, "unable to authenticate")
+	var buf bytes.Buffer
+	if body != nil {
+		assert.NoError(t, json.NewEncoder(&buf).Encode(body))
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, "/api/v1"+path, &buf)
+	req.Header.Set("Authorization", oauthToken)
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestThreads(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil {
+		t.Skip("thread tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	w := apiRequest(t, "POST", TestUsers[0].Email, TestUsers[0].Password, "/channels/new", content.Channel{Title: "thread channel", Open: true})
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	w = apiRequest(t, "POST", TestUsers[1].Email, TestUsers[1].Password, "/channels/"+channel.ID.String()+"/subscribe", map[string]bool{"subscribe": true})
+	assert.Equal(t, 200, w.Code)
+
+	author := connectWebSocket(t, server, TestUsers[0].Email, TestUsers[0].Password)
+	defer author.Close()
+	replier := connectWebSocket(t, server, TestUsers[1].Email, TestUsers[1].Password)
+	defer replier.Close()
+
+	assert.NoError(t, author.WriteJSON(messaging.Protocol{Type: "msg", Message: &content.Message{ChannelID: &channel.ID, Message: "root"}}))
+	root := readFrame(t, author, "msg")
+	if !assert.NotNil(t, root.Message) {
+		return
+	}
+
+	t.Run("followers are told about replies", func(t *testing.T) {
+		for _, v := range []string{"first", "second"} {
+			assert.NoError(t, replier.WriteJSON(messaging.Protocol{Type: "msg",
+				Message: &content.Message{InReplyToID: &root.Message.ID, Message: v}}))
+			notified := readFrame(t, author, "thread")
+			assert.Equal(t, root.Message.ID.String(), notified.ID)
+			if assert.NotNil(t, notified.Message) {
+				assert.Equal(t, v, notified.Message.Message)
+				assert.Equal(t, &channel.ID, notified.Message.ChannelID, "replies should be placed in the channel of the thread")
+			}
+		}
+	})
+
+	type Thread struct {
+		Message    content.Message   `json:"message"`
+		Replies    []content.Message `json:"replies"`
+		NextCursor string            `json:"nextCursor"`
+		Unread     int               `json:"unread"`
+	}
+	getThread := func(query string) (thread Thread) {
+		w := apiRequest(t, "GET", TestUsers[0].Email, TestUsers[0].Password, "/messages/"+root.Message.ID.String()+"/thread"+query, nil)
+		assert.Equal(t, 200, w.Code)
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&thread))
+		return
+	}
+
+	t.Run("threads are paged", func(t *testing.T) {
+		first := getThread("?limit=1")
+		assert.Equal(t, 2, first.Message.ReplyCount)
+		assert.Equal(t, 1, first.Message.ReplyParticipants)
+		assert.NotNil(t, first.Message.LastReplyAt)
+		assert.Equal(t, 2, first.Unread)
+		if assert.Len(t, first.Replies, 1) && assert.NotEmpty(t, first.NextCursor) {
+			assert.Equal(t, "first", first.Replies[0].Message)
+
+			second := getThread("?limit=1&cursor=" + first.NextCursor)
+			if assert.Len(t, second.Replies, 1) {
+				assert.Equal(t, "second", second.Replies[0].Message)
+			}
+			assert.Empty(t, second.NextCursor)
+		}
+	})
+
+	t.Run("reading a thread clears unread replies", func(t *testing.T) {
+		w := apiRequest(t, "POST", TestUsers[0].Email, TestUsers[0].Password, "/messages/"+root.Message.ID.String()+"/thread/read", nil)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, 0, getThread("").Unread)
+	})
+}
+
+func TestReactions(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil {
+		t.Skip("reaction tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	w := apiRequest(t, "POST", TestUsers[0].Email, TestUsers[0].Password, "/channels/new", content.Channel{Title: "reaction channel", Open: true})
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	w = apiRequest(t, "POST", TestUsers[1].Email, TestUsers[1].Password, "/channels/"+channel.ID.String()+"/subscribe", map[string]bool{"subscribe": true})
+	assert.Equal(t, 200, w.Code)
+
+	author := connectWebSocket(t, server, TestUsers[0].Email, TestUsers[0].Password)
+	defer author.Close()
+	reactor := connectWebSocket(t, server, TestUsers[1].Email, TestUsers[1].Password)
+	defer reactor.Close()
+
+	assert.NoError(t, author.WriteJSON(messaging.Protocol{Type: "msg", Message: &content.Message{ChannelID: &channel.ID, Message: "react to this"}}))
+	posted := readFrame(t, author, "msg")
+	if !assert.NotNil(t, posted.Message) {
+		return
+	}
+	messageID := posted.Message.ID
+
+	// reactions are echoed to the reacting user too, so earlier ones may still be queued
+	readReaction := func(ws *websocket.Conn, emoji string) (like *messaging.Like) {
+		assert.Eventually(t, func() bool {
+			like = readFrame(t, ws, "react").Like
+			return like != nil && like.Emoji == emoji
+		}, 2*time.Second, time.Millisecond, "expected a %s reaction", emoji)
+		return
+	}
+
+	t.Run("users react with several emojis", func(t *testing.T) {
+		for _, emoji := range []string{"🎉", "🚀"} {
+			assert.NoError(t, reactor.WriteJSON(messaging.Protocol{Type: "react", Like: &messaging.Like{MessageID: messageID, Emoji: emoji}}))
+			if reacted := readReaction(author, emoji); assert.NotNil(t, reacted) {
+				assert.Equal(t, TestUsers[1].ID, reacted.UserID)
+				assert.False(t, reacted.Remove)
+			}
+		}
+		w := apiRequest(t, "POST", TestUsers[0].Email, TestUsers[0].Password, "/messages/"+messageID.String()+"/like", nil)
+		assert.Equal(t, 200, w.Code)
+		if liked := readReaction(reactor, content.DefaultReaction); assert.NotNil(t, liked, "likes should be thumbs up reactions") {
+			assert.Equal(t, TestUsers[0].ID, liked.UserID)
+		}
+	})
+
+	t.Run("reactions are removed", func(t *testing.T) {
+		w := apiRequest(t, "DELETE", TestUsers[1].Email, TestUsers[1].Password,
+			"/messages/"+messageID.String()+"/reactions/"+url.PathEscape("🚀"), nil)
+		assert.Equal(t, 200, w.Code)
+		if removed := readReaction(author, "🚀"); assert.NotNil(t, removed) {
+			assert.True(t, removed.Remove)
+		}
+	})
+
+	t.Run("messages carry reaction counts", func(t *testing.T) {
+		w := apiRequest(t, "GET", TestUsers[0].Email, TestUsers[0].Password, "/messages/"+messageID.String()+"/thread", nil)
+		var thread struct {
+			Message content.Message `json:"message"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&thread))
+		assert.Equal(t, []content.Reaction{
+			{Emoji: "🎉", Count: 1, UserIDs: []uuid.UUID{TestUsers[1].ID}},
+			{Emoji: content.DefaultReaction, Count: 1, UserIDs: []uuid.UUID{TestUsers[0].ID}},
+		}, thread.Message.Reactions)
+	})
+
+	t.Run("repeated reactions change nothing", func(t *testing.T) {
+		assert.NoError(t, reactor.WriteJSON(messaging.Protocol{Type: "react", Like: &messaging.Like{MessageID: messageID, Emoji: "🎉"}}))
+		w := apiRequest(t, "POST", TestUsers[0].Email, TestUsers[0].Password, "/messages/"+messageID.String()+"/like", nil)
+		assert.Equal(t, 200, w.Code)
+		assert.NoError(t, reactor.WriteJSON(messaging.Protocol{Type: "react", Like: &messaging.Like{MessageID: messageID, Emoji: "👀"}}))
+		if reacted := readFrame(t, author, "react").Like; assert.NotNil(t, reacted) {
+			assert.Equal(t, "👀", reacted.Emoji, "reactions that are already there shouldn't be sent again")
+		}
+	})
+
+	t.Run("likes from before reactions are migrated", func(t *testing.T) {
+		assert.NoError(t, storeLike(content.MessageLike{MessageID: messageID, UserID: TestUsers[1].ID, LikeAt: time.Now()}))
+		content.InitSchema()
+
+		w := apiRequest(t, "GET", TestUsers[0].Email, TestUsers[0].Password, "/messages/"+messageID.String()+"/thread", nil)
+		var thread struct {
+			Message content.Message `json:"message"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&thread))
+		assert.Contains(t, thread.Message.Reactions,
+			content.Reaction{Emoji: content.DefaultReaction, Count: 2, UserIDs: []uuid.UUID{TestUsers[0].ID, TestUsers[1].ID}})
+	})
+}
+
+// storeLike saves a like the way likes were stored before they became reactions
+func storeLike(like content.MessageLike) error {
+	return server.DB.Create(&like).Error
+}
+
+func TestPins(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil {
+		t.Skip("pin tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	w := apiRequest(t, "POST", TestUsers[0].Email, TestUsers[0].Password, "/channels/new", content.Channel{Title: "pin channel", Open: true})
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	w = apiRequest(t, "POST", TestUsers[1].Email, TestUsers[1].Password, "/channels/"+channel.ID.String()+"/subscribe", map[string]bool{"subscribe": true})
+	assert.Equal(t, 200, w.Code)
+	pins := "/channels/" + channel.ID.String() + "/pins"
+
+	member := connectWebSocket(t, server, TestUsers[1].Email, TestUsers[1].Password)
+	defer member.Close()
+
+	msg, err := content.SaveMessage(TestUsers[0], content.Message{ChannelID: &channel.ID, Message: "job ad", PostingType: "job"})
+	assert.NoError(t, err)
+
+	var pin content.ChannelPin
+	t.Run("moderators pin messages", func(t *testing.T) {
+		w := apiRequest(t, "POST", TestUsers[1].Email, TestUsers[1].Password, pins, map[string]any{"messageId": msg.ID})
+		assert.Equal(t, 403, w.Code, "members can't pin")
+
+		w = apiRequest(t, "POST", TestUsers[0].Email, TestUsers[0].Password, pins, map[string]any{"messageId": msg.ID})
+		assert.Equal(t, 201, w.Code)
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&pin))
+
+		pinned := readFrame(t, member, "pin")
+		if assert.NotNil(t, pinned.Pin) {
+			assert.Equal(t, pin.ID, pinned.Pin.ID)
+			assert.Equal(t, msg.ID, *pinned.Pin.MessageID)
+		}
+	})
+
+	t.Run("links are pinned without a preview when it can't be fetched", func(t *testing.T) {
+		w := apiRequest(t, "POST", TestUsers[0].Email, TestUsers[0].Password, pins, map[string]any{"url": "http://127.0.0.1:1/announcement"})
+		assert.Equal(t, 201, w.Code)
+		var link content.ChannelPin
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&link))
+		if assert.NotNil(t, link.Preview) {
+			assert.Equal(t, "http://127.0.0.1:1/announcement", link.Preview.Url)
+		}
+		readFrame(t, member, "pin")
+	})
+
+	t.Run("members list pins", func(t *testing.T) {
+		w := apiRequest(t, "GET", TestUsers[1].Email, TestUsers[1].Password, pins, nil)
+		assert.Equal(t, 200, w.Code)
+		var list []content.ChannelPin
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+		if assert.Len(t, list, 2) && assert.NotNil(t, list[1].Message) {
+			assert.Equal(t, "job ad", list[1].Message.Message)
+		}
+	})
+
+	t.Run("moderators unpin", func(t *testing.T) {
+		w := apiRequest(t, "DELETE", TestUsers[0].Email, TestUsers[0].Password, pins+"/"+pin.ID.String(), nil)
+		assert.Equal(t, 200, w.Code)
+		unpinned := readFrame(t, member, "unpin")
+		if assert.NotNil(t, unpinned.Pin) {
+			assert.Equal(t, pin.ID, unpinned.Pin.ID)
+		}
+	})
+}
+
+func TestSavedMessages(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil || TestUsers[2].ID == uuid.Nil {
+		t.Skip("saved message tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	w := apiRequest(t, "POST", TestUsers[0].Email, TestUsers[0].Password, "/channels/new", content.Channel{Title: "saved channel", Open: true})
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	w = apiRequest(t, "POST", TestUsers[1].Email, TestUsers[1].Password, "/channels/"+channel.ID.String()+"/subscribe", map[string]bool{"subscribe": true})
+	assert.Equal(t, 200, w.Code)
+
+	var posted []content.Message
+	for _, text := range []string{"first ad", "second ad", "third ad"} {
+		msg, err := content.SaveMessage(TestUsers[0], content.Message{ChannelID: &channel.ID, Message: text})
+		assert.NoError(t, err)
+		posted = append(posted, msg)
+	}
+
+	t.Run("only messages the user can see are saved", func(t *testing.T) {
+		w := apiRequest(t, "POST", TestUsers[2].Email, TestUsers[2].Password, "/messages/"+posted[0].ID.String()+"/save", nil)
+		assert.Equal(t, 403, w.Code)
+	})
+
+	t.Run("saved messages are listed by page", func(t *testing.T) {
+		for _, msg := range posted {
+			w := apiRequest(t, "POST", TestUsers[1].Email, TestUsers[1].Password, "/messages/"+msg.ID.String()+"/save", nil)
+			assert.Equal(t, 200, w.Code)
+		}
+		w := apiRequest(t, "DELETE", TestUsers[1].Email, TestUsers[1].Password, "/messages/"+posted[1].ID.String()+"/save", nil)
+		assert.Equal(t, 200, w.Code)
+
+		w = apiRequest(t, "GET", TestUsers[1].Email, TestUsers[1].Password, "/user/saved?pageSize=1", nil)
+		assert.Equal(t, 200, w.Code)
+		var page struct {
+			Items      []content.SavedMessage `json:"items"`
+			TotalCount int64                  `json:"totalCount"`
+			PageCount  int                    `json:"pageCount"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		assert.EqualValues(t, 2, page.TotalCount)
+		assert.Equal(t, 2, page.PageCount)
+		if assert.Len(t, page.Items, 1) && assert.NotNil(t, page.Items[0].Message) {
+			assert.Equal(t, "third ad", page.Items[0].Message.Message)
+		}
+	})
+
+	t.Run("due reminders are sent once", func(t *testing.T) {
+		ws := connectWebSocket(t, server, TestUsers[1].Email, TestUsers[1].Password)
+		defer ws.Close()
+
+		remindAt := time.Now().Add(-time.Minute)
+		w := apiRequest(t, "POST", TestUsers[1].Email, TestUsers[1].Password, "/messages/"+posted[0].ID.String()+"/save",
+			map[string]any{"remindAt": remindAt})
+		assert.Equal(t, 200, w.Code)
+
+		messaging.SendReminders(time.Now())
+		reminder := readFrame(t, ws, "msg")
+		if assert.NotNil(t, reminder.Message) {
+			assert.Equal(t, "reminder", reminder.Message.SystemFlags)
+			assert.Equal(t, "first ad", reminder.Message.Message)
+			assert.Equal(t, TestUsers[1].ID, *reminder.Message.RecipientID)
+		}
+
+		due, err := content.DueReminders(time.Now())
+		assert.NoError(t, err)
+		assert.Empty(t, due)
+	})
+
+	t.Run("messages of channels left are no longer listed", func(t *testing.T) {
+		w := apiRequest(t, "POST", TestUsers[1].Email, TestUsers[1].Password, "/channels/"+channel.ID.String()+"/subscribe", map[string]bool{"subscribe": false})
+		assert.Equal(t, 200, w.Code)
+
+		w = apiRequest(t, "GET", TestUsers[1].Email, TestUsers[1].Password, "/user/saved", nil)
+		assert.Equal(t, 200, w.Code)
+		var page struct {
+			Items      []content.SavedMessage `json:"items"`
+			TotalCount int64                  `json:"totalCount"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		assert.Zero(t, page.TotalCount)
+		assert.Empty(t, page.Items)
+	})
+}
+
+func TestChannelRoles(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil || TestUsers[2].ID == uuid.Nil {
+		t.Skip("channel role tests depend on the users registered by TestNewUsers")
+	}
+
+	owner, moderator, member := TestUsers[0], TestUsers[1], TestUsers[2]
+
+	w := apiRequest(t, "POST", owner.Email, owner.Password, "/channels/new", content.Channel{Title: "role channel", Open: true})
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	path := "/channels/" + channel.ID.String()
+	for _, user := range []users.User{moderator, member} {
+		w = apiRequest(t, "POST", user.Email, user.Password, path+"/subscribe", map[string]bool{"subscribe": true})
+		assert.Equal(t, 200, w.Code)
+	}
+
+	roles := func() map[uuid.UUID]string {
+		w := apiRequest(t, "GET", member.Email, member.Password, path+"/members", nil)
+		assert.Equal(t, 200, w.Code)
+		var members []content.ChannelParticipant
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&members))
+		roles := map[uuid.UUID]string{}
+		for _, m := range members {
+			roles[m.UserID] = m.Role
+		}
+		return roles
+	}
+
+	t.Run("members don't edit, delete or promote", func(t *testing.T) {
+		w := apiRequest(t, "POST", member.Email, member.Password, path, content.Channel{Title: "taken over"})
+		assert.Equal(t, 403, w.Code)
+		w = apiRequest(t, "DELETE", member.Email, member.Password, path, nil)
+		assert.Equal(t, 403, w.Code)
+		w = apiRequest(t, "POST", member.Email, member.Password, path+"/members/"+member.ID.String(), map[string]string{"role": "moderator"})
+		assert.Equal(t, 403, w.Code)
+		w = apiRequest(t, "POST", member.Email, member.Password, path+"/subscribe", map[string]any{"subscribe": false, "userId": moderator.ID})
+		assert.Equal(t, 403, w.Code)
+	})
+
+	t.Run("owners promote moderators", func(t *testing.T) {
+		w := apiRequest(t, "POST", owner.Email, owner.Password, path+"/members/"+moderator.ID.String(), map[string]string{"role": "moderator"})
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, map[uuid.UUID]string{owner.ID: content.RoleOwner, moderator.ID: content.RoleModerator, member.ID: content.RoleMember}, roles())
+
+		w = apiRequest(t, "POST", moderator.Email, moderator.Password, path, content.Channel{Title: "renamed role channel"})
+		assert.Equal(t, 200, w.Code)
+		w = apiRequest(t, "DELETE", moderator.Email, moderator.Password, path, nil)
+		assert.Equal(t, 403, w.Code, "only owners delete channels")
+		w = apiRequest(t, "POST", moderator.Email, moderator.Password, path+"/subscribe", map[string]any{"subscribe": false, "userId": owner.ID})
+		assert.Equal(t, 403, w.Code, "moderators can't remove owners")
+	})
+
+	t.Run("owners hand over ownership", func(t *testing.T) {
+		w := apiRequest(t, "POST", owner.Email, owner.Password, path+"/subscribe", map[string]bool{"subscribe": false})
+		assert.Equal(t, 403, w.Code, "owners can't leave their channel")
+
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path+"/members/"+moderator.ID.String(), map[string]string{"role": "owner"})
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, map[uuid.UUID]string{owner.ID: content.RoleModerator, moderator.ID: content.RoleOwner, member.ID: content.RoleMember}, roles())
+
+		w = apiRequest(t, "DELETE", moderator.Email, moderator.Password, path, nil)
+		assert.Equal(t, 200, w.Code)
+	})
+}
+
+func TestJoinRequests(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil || TestUsers[2].ID == uuid.Nil {
+		t.Skip("join request tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	owner, applicant, rejected := TestUsers[0], TestUsers[1], TestUsers[2]
+
+	w := apiRequest(t, "POST", owner.Email, owner.Password, "/channels/new", content.Channel{Title: "members only"})
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	path := "/channels/" + channel.ID.String()
+
+	moderator := connectWebSocket(t, server, owner.Email, owner.Password)
+	defer moderator.Close()
+	ws := connectWebSocket(t, server, applicant.Email, applicant.Password)
+	defer ws.Close()
+
+	t.Run("subscribing to a closed channel asks to join", func(t *testing.T) {
+		for _, user := range []users.User{applicant, rejected} {
+			w := apiRequest(t, "POST", user.Email, user.Password, path+"/subscribe", map[string]bool{"subscribe": true})
+			assert.Equal(t, 202, w.Code)
+			requested := readFrame(t, moderator, "join_request")
+			if assert.NotNil(t, requested.Member) {
+				assert.Equal(t, user.ID, requested.Member.UserID)
+				assert.False(t, requested.Member.Approved)
+			}
+		}
+		assert.Eventually(t, func() bool {
+			_, mailed := joinRequestEmails.Load(owner.Email + " " + channel.ID.String())
+			return mailed
+		}, 2*time.Second, 20*time.Millisecond, "moderators should be mailed")
+		assert.ErrorIs(t, content.CanPost(applicant.ID, channel.ID), content.ErrNotParticipant)
+
+		w := apiRequest(t, "GET", applicant.Email, applicant.Password, path+"/requests", nil)
+		assert.Equal(t, 403, w.Code)
+		w = apiRequest(t, "GET", owner.Email, owner.Password, path+"/requests", nil)
+		assert.Equal(t, 200, w.Code)
+		var requests []content.JoinRequest
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&requests))
+		if assert.Len(t, requests, 2) {
+			assert.Equal(t, applicant.Email, requests[0].User.Email)
+		}
+	})
+
+	t.Run("moderators approve and reject", func(t *testing.T) {
+		w := apiRequest(t, "POST", applicant.Email, applicant.Password, path+"/requests/"+applicant.ID.String(), map[string]bool{"approve": true})
+		assert.Equal(t, 403, w.Code)
+
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path+"/requests/"+applicant.ID.String(), map[string]bool{"approve": true})
+		assert.Equal(t, 200, w.Code)
+		joined := readFrame(t, ws, "msg")
+		if assert.NotNil(t, joined.Message) {
+			assert.Equal(t, "subscribed", joined.Message.SystemFlags)
+			assert.NotZero(t, joined.Seq, "join notices are part of the channel stream")
+		}
+		approved := readFrame(t, ws, "msg")
+		if assert.NotNil(t, approved.Message) {
+			assert.Equal(t, "join_approved", approved.Message.SystemFlags)
+			assert.Equal(t, channel.Title, approved.Message.Title)
+		}
+		assert.NoError(t, content.CanPost(applicant.ID, channel.ID))
+
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path+"/requests/"+rejected.ID.String(), map[string]bool{"approve": false})
+		assert.Equal(t, 200, w.Code)
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path+"/requests/"+rejected.ID.String(), map[string]bool{"approve": true})
+		assert.Equal(t, 404, w.Code, "rejected requests are gone")
+	})
+}
+
+func TestInvites(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil || TestUsers[2].ID == uuid.Nil {
+		t.Skip("invite tests depend on the users registered by TestNewUsers")
+	}
+
+	owner, guest, late := TestUsers[0], TestUsers[1], TestUsers[2]
+
+	w := apiRequest(t, "POST", owner.Email, owner.Password, "/channels/new", content.Channel{Title: "invite only"})
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	path := "/channels/" + channel.ID.String() + "/invites"
+
+	var invite content.ChannelInvite
+	t.Run("moderators create invites", func(t *testing.T) {
+		w := apiRequest(t, "POST", guest.Email, guest.Password, path, nil)
+		assert.Equal(t, 403, w.Code)
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path, map[string]any{"role": "owner"})
+		assert.Equal(t, 400, w.Code)
+
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path, map[string]any{"maxUses": 1, "role": "moderator",
+			"expiresAt": time.Now().Add(time.Hour)})
+		assert.Equal(t, 201, w.Code)
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&invite))
+		assert.NotEmpty(t, invite.Code)
+	})
+
+	t.Run("users redeem invites until they are used up", func(t *testing.T) {
+		w := apiRequest(t, "POST", guest.Email, guest.Password, "/invites/"+invite.Code, nil)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, content.RoleModerator, content.ChannelRole(guest.ID, channel.ID))
+
+		w = apiRequest(t, "POST", guest.Email, guest.Password, "/invites/"+invite.Code, nil)
+		assert.Equal(t, 200, w.Code, "members redeeming again don't use up the invite")
+		w = apiRequest(t, "POST", late.Email, late.Password, "/invites/"+invite.Code, nil)
+		assert.Equal(t, 410, w.Code)
+		w = apiRequest(t, "POST", late.Email, late.Password, "/invites/unknown", nil)
+		assert.Equal(t, 404, w.Code)
+	})
+
+	t.Run("moderators list and revoke invites", func(t *testing.T) {
+		w := apiRequest(t, "POST", owner.Email, owner.Password, path, nil)
+		var open content.ChannelInvite
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&open))
+
+		w = apiRequest(t, "DELETE", owner.Email, owner.Password, path+"/"+open.ID.String(), nil)
+		assert.Equal(t, 200, w.Code)
+		w = apiRequest(t, "POST", late.Email, late.Password, "/invites/"+open.Code, nil)
+		assert.Equal(t, 410, w.Code)
+
+		w = apiRequest(t, "GET", guest.Email, guest.Password, path, nil)
+		assert.Equal(t, 200, w.Code)
+		var invites []content.ChannelInvite
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&invites))
+		if assert.Len(t, invites, 2) {
+			assert.NotNil(t, invites[0].RevokedAt)
+			assert.Equal(t, 1, invites[1].Uses)
+			if assert.Len(t, invites[1].Redemptions, 1) {
+				assert.Equal(t, guest.ID, invites[1].Redemptions[0].UserID)
+			}
+		}
+	})
+}
+
+func TestChannelArchive(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[2].ID == uuid.Nil {
+		t.Skip("channel archive tests depend on the users registered by TestNewUsers")
+	}
+
+	owner, admin := TestUsers[0], TestUsers[2]
+
+	w := apiRequest(t, "POST", owner.Email, owner.Password, "/channels/new", content.Channel{Title: "archive channel", Open: true})
+	if !assert.Equal(t, 201, w.Code) {
+		return
+	}
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	path := "/channels/" + channel.ID.String()
+	msg, err := content.SaveMessage(owner, content.Message{ChannelID: &channel.ID, Message: "last words"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	listed := func(query string) bool {
+		w := apiRequest(t, "GET", owner.Email, owner.Password, "/channels?pageSize=100"+query, nil)
+		assert.Equal(t, 200, w.Code)
+		var page struct {
+			Items []content.Channel `json:"items"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		return slices.ContainsFunc(page.Items, func(c content.Channel) bool { return c.ID == channel.ID })
+	}
+
+	t.Run("archived channels are read-only and unlisted", func(t *testing.T) {
+		w := apiRequest(t, "POST", admin.Email, admin.Password, path+"/archive", map[string]bool{"archive": true})
+		assert.Equal(t, 403, w.Code)
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path+"/archive", map[string]bool{"archive": true})
+		assert.Equal(t, 200, w.Code)
+
+		_, err := content.SaveMessage(owner, content.Message{ChannelID: &channel.ID, Message: "anyone there?"})
+		assert.ErrorIs(t, err, content.ErrChannelArchived)
+		w = apiRequest(t, "POST", owner.Email, owner.Password, "/messages/"+msg.ID.String()+"/reactions", map[string]string{"emoji": "👋"})
+		assert.Equal(t, 403, w.Code, "archived channels take no reactions")
+		w = apiRequest(t, "DELETE", owner.Email, owner.Password, "/messages/"+msg.ID.String(), nil)
+		assert.Equal(t, 403, w.Code, "messages of archived channels stay")
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path+"/pins", map[string]any{"messageId": msg.ID})
+		assert.Equal(t, 403, w.Code, "archived channels take no pins")
+		w = apiRequest(t, "POST", admin.Email, admin.Password, path+"/subscribe", map[string]bool{"subscribe": true})
+		assert.Equal(t, 403, w.Code, "archived channels take no members")
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path+"/invites", nil)
+		assert.Equal(t, 403, w.Code, "archived channels take no invites")
+		assert.False(t, listed(""))
+		assert.True(t, listed("&archived=true"))
+	})
+
+	t.Run("moderators restore archived channels", func(t *testing.T) {
+		w := apiRequest(t, "POST", owner.Email, owner.Password, path+"/archive", map[string]bool{"archive": false})
+		assert.Equal(t, 200, w.Code)
+		assert.NoError(t, content.CanPost(owner.ID, channel.ID))
+		assert.True(t, listed(""))
+	})
+
+	t.Run("owners deleting channels archive them", func(t *testing.T) {
+		w := apiRequest(t, "DELETE", owner.Email, owner.Password, path, nil)
+		assert.Equal(t, 200, w.Code)
+		assert.JSONEq(t, `{"status":"OK"}`, w.Body.String())
+		assert.True(t, content.ChannelArchived(channel.ID))
+
+		w = apiRequest(t, "POST", owner.Email, owner.Password, path+"/archive", map[string]bool{"archive": false})
+		assert.Equal(t, 200, w.Code)
+	})
+
+	t.Run("administrators delete channels for good", func(t *testing.T) {
+		ts := httptest.NewServer(router)
+		defer ts.Close()
+		ws := connectWebSocket(t, ts, owner.Email, owner.Password)
+		defer ws.Close()
+		assert.NoError(t, ws.WriteJSON(messaging.Protocol{Type: "join", ChannelID: &channel.ID}))
+		joined := readFrame(t, ws, "huddle")
+		assert.NotNil(t, joined.Huddle)
+
+		w := apiRequest(t, "DELETE", owner.Email, owner.Password, "/admin"+path, nil)
+		assert.Equal(t, 403, w.Code)
+
+		t.Setenv("ADMIN_USERS", "someone@else.com, "+admin.Email)
+		w = apiRequest(t, "DELETE", admin.Email, admin.Password, "/admin"+path, nil)
+		assert.Equal(t, 200, w.Code)
+		w = apiRequest(t, "GET", owner.Email, owner.Password, path, nil)
+		assert.Equal(t, 404, w.Code)
+		_, err := content.MessageAudience(msg.ID)
+		assert.Error(t, err, "messages go with the channel")
+
+		ended := readFrame(t, ws, "huddle")
+		if assert.NotNil(t, ended.Huddle) {
+			assert.NotNil(t, ended.Huddle.EndedAt, "huddles end with their channel")
+		}
+		var huddles int64
+		assert.NoError(t, server.DB.Model(&messaging.Huddle{}).Where("channel_id = ?", channel.ID).Count(&huddles).Error)
+		assert.Zero(t, huddles, "huddles go with the channel")
+	})
+}
+
+func TestUnreadCounts(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil {
+		t.Skip("unread tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	owner, member := TestUsers[0], TestUsers[1]
+
+	w := apiRequest(t, "POST", owner.Email, owner.Password, "/channels/new", content.Channel{Title: "unread counting", Open: true})
+	if !assert.Equal(t, 201, w.Code) {
+		return
+	}
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	path := "/channels/" + channel.ID.String()
+	w = apiRequest(t, "POST", member.Email, member.Password, path+"/subscribe", map[string]bool{"subscribe": true})
+	if !assert.Equal(t, 200, w.Code) {
+		return
+	}
+
+	// more messages than GetChannels preloads or loads with messages=true
+	for i := 0; i < 11; i++ {
+		_, err := content.SaveMessage(owner, content.Message{ChannelID: &channel.ID, Message: fmt.Sprintf("message %d", i)})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	summary := func(user users.User) (unread content.UnreadSummary, count content.ChannelUnread) {
+		w := apiRequest(t, "GET", user.Email, user.Password, "/unread", nil)
+		assert.Equal(t, 200, w.Code)
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&unread))
+		for _, c := range unread.Channels {
+			if c.ChannelID == channel.ID {
+				count = c
+			}
+		}
+		return
+	}
+
+	ws := connectWebSocket(t, server, member.Email, member.Password)
+	defer ws.Close()
+	author := connectWebSocket(t, server, owner.Email, owner.Password)
+	defer author.Close()
+
+	t.Run("mentions are counted and pushed to whoever is mentioned", func(t *testing.T) {
+		assert.NoError(t, author.WriteJSON(messaging.Protocol{Type: "msg",
+			Message: &content.Message{ChannelID: &channel.ID, Message: "what do you think, @" + strings.ToUpper(member.Email) + "?"}}))
+		msg := readFrame(t, author, "msg")
+		if assert.NotNil(t, msg.Message) {
+			assert.Equal(t, []uuid.UUID{member.ID}, msg.Message.Mentions)
+		}
+
+		pushed := readFrame(t, ws, "unread")
+		if assert.NotNil(t, pushed.Unread) {
+			assert.GreaterOrEqual(t, pushed.Unread.Mentions, 1)
+		}
+		_, count := summary(member)
+		assert.Equal(t, content.ChannelUnread{ChannelID: channel.ID, Unread: 12, Mentions: 1}, count)
+	})
+
+	t.Run("channels carry exact counts", func(t *testing.T) {
+		for _, query := range []string{"", "&messages=true"} {
+			w := apiRequest(t, "GET", member.Email, member.Password, "/channels?query=unread%20counting"+query, nil)
+			assert.Equal(t, 200, w.Code)
+			var page struct {
+				Items []content.Channel `json:"items"`
+			}
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+			if assert.Len(t, page.Items, 1) {
+				assert.Equal(t, 12, page.Items[0].UnreadCount)
+				assert.Equal(t, 1, page.Items[0].MentionCount)
+			}
+		}
+	})
+
+	t.Run("own messages aren't unread", func(t *testing.T) {
+		_, count := summary(owner)
+		assert.Zero(t, count.Unread)
+	})
+
+	t.Run("clients ask for the summary over the socket", func(t *testing.T) {
+		assert.NoError(t, ws.WriteJSON(messaging.Protocol{Type: "unread", Ref: "badge"}))
+		reply := readFrame(t, ws, "unread")
+		assert.Equal(t, "badge", reply.Ref)
+		if assert.NotNil(t, reply.Unread) {
+			assert.Contains(t, reply.Unread.Channels, content.ChannelUnread{ChannelID: channel.ID, Unread: 12, Mentions: 1})
+		}
+	})
+
+	t.Run("reading the channel clears its counts", func(t *testing.T) {
+		w := apiRequest(t, "POST", member.Email, member.Password, path+"/read", nil)
+		assert.Equal(t, 200, w.Code)
+		pushed := readFrame(t, ws, "unread")
+		if assert.NotNil(t, pushed.Unread) {
+			assert.NotContains(t, pushed.Unread.Channels, content.ChannelUnread{ChannelID: channel.ID, Unread: 12, Mentions: 1})
+		}
+		_, count := summary(member)
+		assert.Zero(t, count.Unread)
+		assert.Zero(t, count.Mentions)
+	})
+}
+
+func TestEventStreams(t *testing.T) {
+
+	if os.Getenv("CLIENT_ID") == "" || os.Getenv("CLIENT_SECRET") == "" {
+		t.Skip("need to run event stream tests with CLIENT_ID & CLIENT_SECRET specified in environment")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	oauthToken, err := OAUTHsignin(os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"))
+	assert.NoError(t, err, "unable to authenticate")
+	accessToken := url.QueryEscape(strings.TrimPrefix(oauthToken, "Bearer "))
+
+	// frames for the user are produced by typing on a web socket, which is echoed to the user's other connections
+	ws := connectWebSocket(t, server, os.Getenv("CLIENT_ID"), os.Getenv("CLIENT_SECRET"))
+	defer ws.Close()
+	typeSomething := func() uuid.UUID {
+		recipientID, _ := uuid.NewV4()
+		assert.NoError(t, ws.WriteJSON(messaging.Protocol{Type: "typ", Typ: &messaging.Typing{ID: recipientID}}))
+		return recipientID
+	}
+
+	t.Run("unauthenticated stream is rejected", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/v1/events")
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	t.Run("server-sent events carry protocol frames", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/v1/events?access_token=" + accessToken)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		events := bufio.NewScanner(resp.Body)
+		// skips frames of other types, like presence of users from earlier tests
+		next := func(typ string) (proto messaging.Protocol) {
+			for events.Scan() {
+				if data, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+					assert.NoError(t, json.Unmarshal([]byte(data), &proto))
+					if proto.Type == typ {
+						return
+					}
+				}
+			}
+			return
+		}
+
+		assert.Equal(t, "auth", next("auth").Type)
+		typeSomething()
+		assert.Equal(t, "typ", next("typ").Type)
+	})
+
+	t.Run("long-poll returns queued frames", func(t *testing.T) {
+		type Resp struct {
+			Session string               `json:"session"`
+			Frames  []messaging.Protocol `json:"frames"`
+		}
+		poll := func(session string) (resp Resp) {
+			w, err := http.Get(server.URL + "/api/v1/events/poll?access_token=" + accessToken + "&session=" + session)
+			if assert.NoError(t, err) {
+				defer w.Body.Close()
+				assert.Equal(t, 200, w.StatusCode)
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			}
+			return
+		}
+
+		started := poll("")
+		assert.NotEmpty(t, started.Session)
+		typeSomething()
+		// frames of other types, like presence of users from earlier tests, may be queued too
+		assert.Eventually(t, func() bool {
+			for _, v := range poll(started.Session).Frames {
+				if v.Type == "typ" {
+					return true
+				}
+			}
+			return false
+		}, 2*time.Second, time.Millisecond, "the typing frame should be polled")
+
+		// a poll the client gives up on leaves its frames for the next one
+		typedID := typeSomething()
+		time.Sleep(100 * time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", "/api/v1/events/poll?access_token="+accessToken+"&session="+started.Session, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		assert.True(t, slices.ContainsFunc(poll(started.Session).Frames, func(v messaging.Protocol) bool {
+			return v.Typ != nil && v.Typ.ID == typedID && !v.Typ.Stop
+		}), "the typing frame should survive the cancelled poll")
+	})
+}
+
+func TestResume(t *testing.T) {
+
+	if TestUsers[3].ID == uuid.Nil {
+		t.Skip("resume tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	user := TestUsers[3]
+	var channels [2]content.Channel
+	for i := range channels {
+		w := apiRequest(t, "POST", user.Email, user.Password, "/channels/new", content.Channel{Title: fmt.Sprintf("resume channel %d", i)})
+		if !assert.Equal(t, 201, w.Code) {
+			return
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&channels[i]))
+	}
+	behind, further := channels[0], channels[1]
+
+	// the client sees a message in each channel, then goes away
+	ws := connectWebSocket(t, server, user.Email, user.Password)
+	seen := map[uuid.UUID]uint64{}
+	for _, channel := range channels {
+		assert.NoError(t, ws.WriteJSON(messaging.Protocol{Type: "msg", Message: &content.Message{ChannelID: &channel.ID, Message: "before"}}))
+		posted := readFrame(t, ws, "msg")
+		if !assert.NotZero(t, posted.Seq) {
+			return
+		}
+		seen[channel.ID] = posted.Seq
+	}
+	ws.Close()
+
+	// more is posted in one channel than a replay takes, so only the other is replayed
+	for i := 0; i < 50; i++ {
+		_, err := content.SaveMessage(user, content.Message{ChannelID: &behind.ID, Message: fmt.Sprintf("missed %d", i)})
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 300; i++ {
+		_, err := content.SaveMessage(user, content.Message{ChannelID: &further.ID, Message: fmt.Sprintf("missed %d", i)})
+		assert.NoError(t, err)
+	}
+
+	ws = connectWebSocket(t, server, user.Email, user.Password)
+	defer ws.Close()
+	assert.NoError(t, ws.WriteJSON(messaging.Protocol{Type: "resume", Resume: seen}))
+
+	var replayed []uint64
+	resynced := false
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var proto messaging.Protocol
+		if !assert.NoError(t, ws.ReadJSON(&proto), "expected the resume to finish") || proto.Type == "resumed" {
+			break
+		}
+		switch {
+		case proto.Type == "msg" && proto.ChannelID != nil && *proto.ChannelID == behind.ID:
+			replayed = append(replayed, proto.Seq)
+		case proto.Type == "msg" && proto.ChannelID != nil && *proto.ChannelID == further.ID:
+			assert.Fail(t, "the channel too far behind shouldn't be replayed")
+		case proto.Type == "resync" && proto.ChannelID != nil && *proto.ChannelID == further.ID:
+			resynced = true
+		}
+	}
+
+	if assert.Len(t, replayed, 50) {
+		assert.Greater(t, replayed[0], seen[behind.ID])
+		assert.True(t, slices.IsSorted(replayed), "replayed messages should be in stream order")
+	}
+	assert.True(t, resynced, "the channel too far behind should be resynced")
+}
+
+func TestFanOut(t *testing.T) {
+
+	if TestUsers[0].ID == uuid.Nil || TestUsers[1].ID == uuid.Nil || TestUsers[4].ID == uuid.Nil {
+		t.Skip("fan-out tests depend on the users registered by TestNewUsers")
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	sender, member, outsider := TestUsers[0], TestUsers[1], TestUsers[4]
+
+	w := apiRequest(t, "POST", sender.Email, sender.Password, "/channels/new", content.Channel{Title: "fan-out channel", Open: true})
+	if !assert.Equal(t, 201, w.Code) {
+		return
+	}
+	var channel content.Channel
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&channel))
+	w = apiRequest(t, "POST", member.Email, member.Password, "/channels/"+channel.ID.String()+"/subscribe", map[string]bool{"subscribe": true})
+	assert.Equal(t, 200, w.Code)
+
+	senderWS := connectWebSocket(t, server, sender.Email, sender.Password)
+	defer senderWS.Close()
+	senderOther := connectWebSocket(t, server, sender.Email, sender.Password)
+	defer senderOther.Close()
+	memberWS := connectWebSocket(t, server, member.Email, member.Password)
+	defer memberWS.Close()
+	outsiderWS := connectWebSocket(t, server, outsider.Email, outsider.Password)
+	defer outsiderWS.Close()
+
+	var posted, direct messaging.Protocol
+
+	t.Run("channel frames reach the members", func(t *testing.T) {
+		assert.NoError(t, senderWS.WriteJSON(messaging.Protocol{Type: "typ", Typ: &messaging.Typing{ID: channel.ID}}))
+		typing := readFrame(t, memberWS, "typ")
+		if assert.NotNil(t, typing.Typ) {
+			assert.Equal(t, channel.ID, typing.Typ.ID)
+		}
+
+		assert.NoError(t, senderWS.WriteJSON(messaging.Protocol{Type: "msg", Message: &content.Message{ChannelID: &channel.ID, Message: "members only"}}))
+		posted = readFrame(t, memberWS, "msg")
+		if !assert.NotNil(t, posted.Message) {
+			return
+		}
+		assert.Equal(t, "members only", posted.Message.Message)
+
+		assert.NoError(t, memberWS.WriteJSON(messaging.Protocol{Type: "read", Read: &messaging.Read{MessageID: posted.Message.ID}}))
+		read := readFrame(t, senderWS, "read")
+		if assert.NotNil(t, read.Read) {
+			assert.Equal(t, member.ID, read.Read.UserID)
+		}
+	})
+
+	t.Run("direct messages reach only the sender and the recipient", func(t *testing.T) {
+		assert.NoError(t, senderWS.WriteJSON(messaging.Protocol{Type: "msg", Message: &content.Message{RecipientID: &member.ID, Message: "just between us"}}))
+		direct = readFrame(t, memberWS, "msg")
+		if !assert.NotNil(t, direct.Message) {
+			return
+		}
+		assert.Equal(t, "just between us", direct.Message.Message)
+		echoed := readFrame(t, senderOther, "msg")
+		for echoed.Message != nil && echoed.Message.ID != direct.Message.ID {
+			echoed = readFrame(t, senderOther, "msg")
+		}
+		assert.NotNil(t, echoed.Message, "the sender's other sockets should get the direct message")
+	})
+
+	t.Run("outsiders get none of it", func(t *testing.T) {
+		outsiderWS.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		for {
+			var proto messaging.Protocol
+			if outsiderWS.ReadJSON(&proto) != nil {
+				break
+			}
+			switch proto.Type {
+			case "msg":
+				if proto.Message != nil {
+					if proto.Message.ChannelID != nil {
+						assert.NotEqual(t, channel.ID, *proto.Message.ChannelID, "outsider received a channel message")
+					}
+					if direct.Message != nil {
+						assert.NotEqual(t, direct.Message.ID, proto.Message.ID, "outsider received a direct message")
+					}
+				}
+			case "typ":
+				if proto.Typ != nil {
+					assert.NotEqual(t, channel.ID, proto.Typ.ID, "outsider received a typing frame")
+				}
+			case "read":
+				if proto.Read != nil && posted.Message != nil {
+					assert.NotEqual(t, posted.Message.ID, proto.Read.MessageID, "outsider received a read frame")
+				}
+			}
+		}
+	})
+}
@@ -98,6 +98,14 @@ func IndexEntry(id uuid.UUID, content ItemDocument) {
 	}
 }
 
+// RemoveEntry drops an entry from the index
+func RemoveEntry(id uuid.UUID) {
+	err := Index.Delete(id.String())
+	if err != nil {
+		slog.Error("unable to remove entry", slog.String("id", id.String()), slog.Any("err", err))
+	}
+}
+
 func Search(freetext string) []string {
 
 	query := bleve.NewMatchQuery(freetext)
@@ -15,6 +15,7 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -48,12 +49,23 @@ type User struct {
 
 	IPAddress string     `json:"ipAddress,omitempty" gorm:"type:varchar(255);"`
 	LastLogin *time.Time `json:"lastLogin,omitempty"`
+	LastSeen  *time.Time `json:"-"` // only shared through presence lookups
 
 	Endpoint string `json:"endpoint" gorm:"varchar(255)"`
 	Auth     string `json:"auth" gorm:"varchar(255)"`
 	P256dh   string `json:"p256dh" gorm:"varchar(255)"`
 }
 
+// IsAdmin tells whether a user is one of the administrators listed by email in ADMIN_USERS
+func IsAdmin(user User) bool {
+	for _, email := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if email = strings.TrimSpace(email); email != "" && strings.EqualFold(email, user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u User) GetTitle() string {
 	if u.SurName == "" && u.GivenName == "" {
 		if u.ContactEmail {
@@ -173,6 +185,7 @@ func updateUser(user User, w http.ResponseWriter, r *http.Request) {
 	userMod.Password = ""
 	userMod.ID = uuid.Nil
 	userMod.LastLogin = nil
+	userMod.LastSeen = nil
 	userMod.Email = ""
 	//delete(userMod, "LastLogin")
 	//delete(userMod, "Email")
@@ -29,18 +29,26 @@ func GetUrlData(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, render.M{"message": "Unable to get url from form request"})
 		return
 	}
-	s, err := goscraper.Scrape(url, 5)
+	pvw, err := FetchPreview(url)
 	if err != nil {
-		slog.Error("unable to preview url", slog.Any("err", err))
 		render.Status(r, http.StatusBadRequest)
 		render.JSON(w, r, render.M{"message": "Unable to preview url"})
 		return
 	}
-	var pvw Preview
+
+	render.JSON(w, r, pvw)
+}
+
+// FetchPreview scrapes the title, description and images of a web page
+func FetchPreview(url string) (pvw Preview, err error) {
+	s, err := goscraper.Scrape(url, 5)
+	if err != nil {
+		slog.Error("unable to preview url", slog.String("url", url), slog.Any("err", err))
+		return pvw, err
+	}
 	pvw.Url = s.Preview.Link
 	pvw.Title = s.Preview.Title
 	pvw.Description = s.Preview.Description
 	pvw.Images = s.Preview.Images
-
-	render.JSON(w, r, pvw)
+	return pvw, nil
 }